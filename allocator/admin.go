@@ -0,0 +1,230 @@
+package allocator
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// adminAPIVersion 管理接口的版本，写在每个响应的 apiVersion 字段，字段不兼容的修改需要新的版本路径
+const adminAPIVersion = "v1"
+
+// pickerState 服务当前使用的 picker 以及生成它的配置版本
+type pickerState struct {
+	picker        *allocatorPicker
+	configPath    string
+	configVersion string
+	builtAt       time.Time
+}
+
+// picker 在连接变化时会重建，管理接口读取每个服务最新的 picker
+var (
+	pickerMu sync.Mutex
+	pickers  = make(map[string]*pickerState)
+)
+
+// configVersion 配置文件中服务配置的哈希，配置修改后版本不同；没有该服务的配置时为空
+// 按 JSON 的内容计算，与格式、其他服务的配置无关
+func configVersion(data []byte, serviceName string) string {
+	var config map[string]interface{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return ""
+	}
+	sc, ok := config[serviceName]
+	if !ok {
+		return ""
+	}
+	canonical, err := json.Marshal(sc)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:6])
+}
+
+// configFileVersion 读取配置文件计算服务配置的版本
+func configFileVersion(configPath string, serviceName string) string {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return ""
+	}
+	return configVersion(data, serviceName)
+}
+
+// registerPicker 记录服务最新的 picker 和它使用的配置文件
+func registerPicker(p *allocatorPicker, configPath string) {
+	pickerMu.Lock()
+	defer pickerMu.Unlock()
+	pickers[p.serviceName] = &pickerState{picker: p, configPath: configPath, configVersion: configFileVersion(configPath, p.serviceName), builtAt: time.Now()}
+}
+
+// getPickerState 返回服务状态的副本，没有该服务时返回 nil
+func getPickerState(name string) *pickerState {
+	pickerMu.Lock()
+	defer pickerMu.Unlock()
+	s, ok := pickers[name]
+	if !ok {
+		return nil
+	}
+	state := *s
+	return &state
+}
+
+// adminService /v1/services 中的一个服务
+type adminService struct {
+	Name          string    `json:"name"`
+	ConfigVersion string    `json:"configVersion"`
+	BuiltAt       time.Time `json:"builtAt"`
+	Conns         int       `json:"conns"`
+	Groups        int       `json:"groups"`
+}
+
+// adminGroup /v1/services/{name}/groups 中的一个分组，包括配置和当前分配到的地址
+type adminGroup struct {
+	Name     string            `json:"name"`
+	Number   int               `json:"number"`
+	Selector map[string]string `json:"selector,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Weight   []float64         `json:"weight,omitempty"`
+	Addrs    []string          `json:"addrs"`
+	// Breaker 分组的熔断状态，没有配置熔断时为空
+	Breaker string `json:"breaker,omitempty"`
+}
+
+// adminConn /v1/services/{name}/conns 中的一个连接
+type adminConn struct {
+	Addr   string            `json:"addr"`
+	Group  string            `json:"group"`
+	Load   float64           `json:"load"`
+	Weight float64           `json:"weight"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// PickRate 最近 10 秒每秒选中的次数
+	PickRate float64 `json:"pickRate"`
+	// Ejected 被异常检测摘除
+	Ejected bool `json:"ejected"`
+}
+
+// conns 返回连接状态的副本
+func (p *allocatorPicker) conns() []adminConn {
+	_, hosts, _ := outlierSnapshot(p.serviceName)
+	rates := p.pickRate.Rates(pickRateWindow)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := make([]adminConn, 0, len(p.connInfos))
+	for _, ci := range p.connInfos {
+		conns = append(conns, adminConn{Addr: ci.addr, Group: ci.group, Load: ci.load, Weight: ci.weight, Labels: ci.labels,
+			PickRate: rates[ci.addr], Ejected: hosts[ci.addr].Ejected})
+	}
+	return conns
+}
+
+// currentConfig 返回 picker 当前使用的配置，配置可以通过 dashboard 修改
+func (p *allocatorPicker) currentConfig() *serviceConfig {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.config
+}
+
+// groups 返回分组配置和分配到的地址，没有配置的分组（如 notGrouped）只有地址
+func (p *allocatorPicker) groups() []adminGroup {
+	byName := make(map[string]*adminGroup)
+	breakerStatuses, _ := breakerSnapshot(p.serviceName)
+	if config := p.currentConfig(); config != nil {
+		for name, info := range config.Group {
+			byName[name] = &adminGroup{Name: name, Number: info.Number, Selector: info.Selector, Labels: info.Labels,
+				Weight: info.Weight, Addrs: []string{}, Breaker: breakerStatuses[name].State}
+		}
+	}
+	for _, c := range p.conns() {
+		g, ok := byName[c.Group]
+		if !ok {
+			g = &adminGroup{Name: c.Group, Addrs: []string{}}
+			byName[c.Group] = g
+		}
+		g.Addrs = append(g.Addrs, c.Addr)
+	}
+	groups := make([]adminGroup, 0, len(byName))
+	for _, g := range byName {
+		groups = append(groups, *g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return groups
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	jsonData, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, "Error formatting JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(jsonData)
+}
+
+// listServices GET /v1/services，返回所有服务
+func listServices(w http.ResponseWriter, r *http.Request) {
+	pickerMu.Lock()
+	states := make([]pickerState, 0, len(pickers))
+	for _, s := range pickers {
+		states = append(states, *s)
+	}
+	pickerMu.Unlock()
+
+	services := make([]adminService, 0, len(states))
+	for _, s := range states {
+		services = append(services, adminService{Name: s.picker.serviceName, ConfigVersion: s.configVersion,
+			BuiltAt: s.builtAt, Conns: len(s.picker.conns()), Groups: len(s.picker.groups())})
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Name < services[j].Name
+	})
+	writeJSON(w, map[string]interface{}{"apiVersion": adminAPIVersion, "services": services})
+}
+
+// serviceResource GET /v1/services/{name}/groups、/v1/services/{name}/conns
+// POST /v1/services/{name}/preview、/v1/services/{name}/apply 修改分组，见 dashboard.go
+func serviceResource(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/services/"), "/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		http.NotFound(w, r)
+		return
+	}
+	name, resource := parts[0], parts[1]
+	s := getPickerState(name)
+	if s == nil {
+		http.Error(w, "target service not found", http.StatusNotFound)
+		return
+	}
+	if resource == "preview" || resource == "apply" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		editGroups(w, r, s, resource == "apply")
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	resp := map[string]interface{}{"apiVersion": adminAPIVersion, "service": name, "configVersion": s.configVersion}
+	switch resource {
+	case "groups":
+		resp["groups"] = s.picker.groups()
+	case "conns":
+		resp["conns"] = s.picker.conns()
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, resp)
+}
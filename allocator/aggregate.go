@@ -0,0 +1,223 @@
+package allocator
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Chen-Jin-yuan/grpc/monitor"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// peerTimeout 请求一个副本的超时时间
+const peerTimeout = 2 * time.Second
+
+var (
+	aggregateMu sync.Mutex
+	// requestCounters 本副本的请求计数，由 SetRequestCounters 设置，通过 /request-counters 输出快照
+	requestCounters *monitor.RequestCounters
+	// listPeers 返回所有副本的 http 地址（host:port），由 EnablePeerAggregation 设置
+	listPeers func() ([]string, error)
+)
+
+var peerClient = &http.Client{Timeout: peerTimeout}
+
+// SetRequestCounters 设置本副本的请求计数，例如 monitor.UnaryServerInterceptor 使用的 RequestCounters
+func SetRequestCounters(rcs *monitor.RequestCounters) {
+	aggregateMu.Lock()
+	defer aggregateMu.Unlock()
+	requestCounters = rcs
+}
+
+// EnablePeerAggregation 设置副本列表，/aggregate 汇总所有副本的 allocator 状态和请求计数
+// lister 返回各副本 allocator http 服务的地址（host:port），例如 consul 的 Client.PeerLister，为 nil 时关闭汇总
+func EnablePeerAggregation(lister func() ([]string, error)) {
+	aggregateMu.Lock()
+	defer aggregateMu.Unlock()
+	listPeers = lister
+}
+
+// replicaInfo 一个副本的数据，请求失败时只有 Error
+type replicaInfo struct {
+	SvcInfo          interface{}               `json:"svc_info,omitempty"`
+	WaitingRequests  map[string]map[string]int `json:"waiting_requests,omitempty"`
+	OutReadyRequests map[string]map[string]int `json:"out_ready_requests,omitempty"`
+	RequestCounters  map[string]map[string]int `json:"request_counters,omitempty"`
+	Error            string                    `json:"error,omitempty"`
+
+	// counters 从快照恢复的请求计数，快照无法合并时为 nil 并记录 Error
+	counters *monitor.RequestCounters
+}
+
+// aggregateInfo 所有副本相加的结果
+type aggregateInfo struct {
+	Replicas         int                       `json:"replicas"`
+	Failed           int                       `json:"failed"`
+	WaitingRequests  map[string]map[string]int `json:"waiting_requests"`
+	OutReadyRequests map[string]map[string]int `json:"out_ready_requests"`
+	RequestCounters  map[string]map[string]int `json:"request_counters"`
+}
+
+// getJSON 请求副本的接口，404 时返回 false 和 nil
+func getJSON(peer string, path string, query url.Values, v interface{}) (bool, error) {
+	u := url.URL{Scheme: "http", Host: peer, Path: path, RawQuery: query.Encode()}
+	resp, err := peerClient.Get(u.String())
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return true, json.NewDecoder(resp.Body).Decode(v)
+}
+
+// fetchReplica 获取一个副本的 /svc-info、/counter 和 /request-counters
+func fetchReplica(peer string, svcName string) *replicaInfo {
+	info := &replicaInfo{}
+	query := url.Values{"name": {svcName}}
+	if _, err := getJSON(peer, "/svc-info", query, &info.SvcInfo); err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	var counter map[string]map[string]map[string]int
+	if _, err := getJSON(peer, "/counter", query, &counter); err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	info.WaitingRequests = counter["waiting_requests"]
+	info.OutReadyRequests = counter["out_ready_requests"]
+	var snapshot monitor.CountersSnapshot
+	found, err := getJSON(peer, "/request-counters", nil, &snapshot)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	if found {
+		rcs := monitor.NewRequestCounters()
+		if err = rcs.Merge(&snapshot); err == nil {
+			info.RequestCounters, err = rcs.ToJSON()
+		}
+		if err != nil {
+			info.Error = "merge request counters: " + err.Error()
+			return info
+		}
+		info.counters = rcs
+	}
+	return info
+}
+
+// addGroups 把分组的请求数加到 total 上
+func addGroups(total map[string]map[string]int, groups map[string]map[string]int) {
+	for serviceName, counts := range groups {
+		if total[serviceName] == nil {
+			total[serviceName] = make(map[string]int)
+		}
+		for groupName, n := range counts {
+			total[serviceName][groupName] += n
+		}
+	}
+}
+
+// getRequestCounters 返回本副本请求计数的快照，没有设置 RequestCounters 时返回 404
+func getRequestCounters(w http.ResponseWriter, r *http.Request) {
+	aggregateMu.Lock()
+	rcs := requestCounters
+	aggregateMu.Unlock()
+	if rcs == nil {
+		http.Error(w, "request counters are not set", http.StatusNotFound)
+		return
+	}
+	snapshot, err := rcs.Snapshot()
+	if err != nil {
+		http.Error(w, "Error taking snapshot: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	jsonData, err := json.Marshal(snapshot)
+	if err != nil {
+		http.Error(w, "Error formatting JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(jsonData)
+}
+
+// getAggregateInfo 并发请求所有副本，返回每个副本的数据和相加的结果
+// 格式为 {"replicas": {"10.0.0.1:10001": {...}}, "total": {"replicas": 2, "failed": 0, "waiting_requests": ..., "request_counters": ...}}
+func getAggregateInfo(w http.ResponseWriter, r *http.Request) {
+	svcName := r.URL.Query().Get("name")
+	if svcName == "" {
+		http.Error(w, "Missing name parameter", http.StatusBadRequest)
+		return
+	}
+	aggregateMu.Lock()
+	lister := listPeers
+	aggregateMu.Unlock()
+	if lister == nil {
+		http.Error(w, "peer aggregation is not enabled", http.StatusNotFound)
+		return
+	}
+	peers, err := lister()
+	if err != nil {
+		http.Error(w, "Error listing peers: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	sort.Strings(peers)
+
+	replicas := make(map[string]*replicaInfo, len(peers))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			info := fetchReplica(peer, svcName)
+			if info.Error != "" {
+				log.Error().Msgf("fetch replica %s err: %s\n", peer, info.Error)
+			}
+			mu.Lock()
+			replicas[peer] = info
+			mu.Unlock()
+		}(peer)
+	}
+	wg.Wait()
+
+	total := aggregateInfo{
+		Replicas:         len(peers),
+		WaitingRequests:  make(map[string]map[string]int),
+		OutReadyRequests: make(map[string]map[string]int),
+	}
+	merged := monitor.NewRequestCounters()
+	for _, info := range replicas {
+		// 请求失败或请求计数无法合并的副本都记录了 Error，整个副本不计入总数，避免输出不完整的总数
+		if info.Error != "" {
+			total.Failed++
+			continue
+		}
+		addGroups(total.WaitingRequests, info.WaitingRequests)
+		addGroups(total.OutReadyRequests, info.OutReadyRequests)
+		if info.counters != nil {
+			merged.MergeCounters(info.counters)
+		}
+	}
+	if total.RequestCounters, err = merged.ToJSON(); err != nil {
+		http.Error(w, "Error merging counters: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonData, err := json.MarshalIndent(map[string]interface{}{"replicas": replicas, "total": total}, "", "  ")
+	if err != nil {
+		http.Error(w, "Error formatting JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(jsonData)
+}
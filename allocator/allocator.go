@@ -1,6 +1,8 @@
 package allocator
 
 import (
+	"github.com/Chen-Jin-yuan/grpc/labels"
+	"github.com/Chen-Jin-yuan/grpc/monitor"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc/metadata"
 	"sort"
@@ -20,8 +22,73 @@ var firstAllocateAll = true
 // NewBuilder creates a new weight balancer builder.
 // HealthCheck 会使用服务端的健康检查来判断服务是否可用，如果服务端没有实现健康检查，则该配置不起作用
 func newBuilder(configPath string, httpServerPort int) balancer.Builder {
-	return base.NewBalancerBuilderV2(Name, &allocatorPickerBuilder{allocatorConfigPath: configPath,
-		allocatorPort: httpServerPort}, base.Config{HealthCheck: true})
+	return &allocatorBuilder{pb: allocatorPickerBuilder{allocatorConfigPath: configPath, allocatorPort: httpServerPort}}
+}
+
+// allocatorBuilder 为每个 ClientConn 创建一个 ccPickerBuilder，用来判断 picker 是否已经被替换
+type allocatorBuilder struct {
+	pb allocatorPickerBuilder
+}
+
+func (b *allocatorBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	cb := &ccPickerBuilder{allocatorPickerBuilder: b.pb}
+	bal := base.NewBalancerBuilderV2(Name, cb, base.Config{HealthCheck: true}).Build(cc, opts)
+	return &allocatorBalancer{baseBalancer: bal.(baseBalancer), cb: cb}
+}
+
+func (b *allocatorBuilder) Name() string {
+	return Name
+}
+
+// baseBalancer base 包创建的 balancer 同时实现了 Balancer 和 V2Balancer
+type baseBalancer interface {
+	balancer.Balancer
+	balancer.V2Balancer
+}
+
+// allocatorBalancer 关闭时让当前 picker 失效
+type allocatorBalancer struct {
+	baseBalancer
+	cb *ccPickerBuilder
+}
+
+func (b *allocatorBalancer) Close() {
+	b.cb.setCurrent(nil)
+	b.baseBalancer.Close()
+}
+
+// ccPickerBuilder 记录一个 ClientConn 当前使用的 picker
+// Pick 在排队时会释放锁，期间 picker 可能被替换，拿到配额后需要确认 picker 仍然有效
+type ccPickerBuilder struct {
+	allocatorPickerBuilder
+	mu      sync.Mutex
+	current *allocatorPicker
+}
+
+func (cb *ccPickerBuilder) Build(info base.PickerBuildInfo) balancer.V2Picker {
+	picker := cb.allocatorPickerBuilder.Build(info)
+	p, _ := picker.(*allocatorPicker)
+	if p != nil {
+		p.builder = cb
+	}
+	cb.setCurrent(p)
+	return picker
+}
+
+func (cb *ccPickerBuilder) setCurrent(p *allocatorPicker) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.current = p
+}
+
+// isCurrent p 是否仍是 ClientConn 正在使用的 picker，没有 builder（测试中直接构建）时总是有效
+func (cb *ccPickerBuilder) isCurrent(p *allocatorPicker) bool {
+	if cb == nil {
+		return true
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.current == p
 }
 
 func Init(configPath string, httpServerPort int) {
@@ -49,6 +116,7 @@ func (pb *allocatorPickerBuilder) Build(info base.PickerBuildInfo) balancer.V2Pi
 			sc:     subConn,
 			group:  "",
 			addr:   subConnInfo.Address.Addr,
+			labels: labels.Labels(subConnInfo.Address),
 			load:   0,
 			weight: -1,
 		})
@@ -71,23 +139,47 @@ func (pb *allocatorPickerBuilder) Build(info base.PickerBuildInfo) balancer.V2Pi
 		log.Error().Msgf("allocatorPicker loadConfig error: %v", err)
 	}
 	log.Info().Msgf("allocatorPicker load [%s] config: %+v", serviceName, svcConfig)
+	recordPickerBuild(serviceName, cis)
 
-	// 启动 http 服务器
+	// 启动 http 服务器，已经通过 UseServeMux 注册到调用方的 mux 时不再启动
 	if firstStart {
 		firstStart = false
-		go httpServerStart(pb.allocatorPort)
+		if !externalMux() {
+			go httpServerStart(pb.allocatorPort)
+		}
+	}
+
+	var outlier *outlierDetector
+	var groupBreakers map[string]*circuitBreaker
+	var groupThrottlers map[string]*throttler
+	var groupLimiters map[string]*groupLimiter
+	if svcConfig != nil {
+		outlier = getOutlierDetector(serviceName, svcConfig.OutlierDetection, cis)
+		groupBreakers = getBreakers(serviceName, svcConfig)
+		groupThrottlers = getThrottlers(serviceName, svcConfig)
+		groupLimiters = getLimiters(serviceName, svcConfig)
 	}
 
-	return &allocatorPicker{
-		connInfos: cis,
-		config:    svcConfig,
+	p := &allocatorPicker{
+		serviceName: serviceName,
+		connInfos:   cis,
+		config:      svcConfig,
+		outlier:     outlier,
+		breakers:    groupBreakers,
+		throttlers:  groupThrottlers,
+		limiters:    groupLimiters,
+		pickRate:    pickRates.GetCounter(serviceName),
 	}
+	registerPicker(p, pb.allocatorConfigPath)
+	return p
 }
 
 type connInfo struct {
 	sc    balancer.SubConn
 	group string
 	addr  string
+	// labels 副本标签，由服务发现写入地址的 Attributes，用于匹配分组的 labels 配置
+	labels map[string]string
 
 	/* load 用于负载均衡，每次选择最小 load 连接。weight 指定负载比例。一个连接使用一次后，load 更新为 load + 1 / weight
 	 * weight 是一个百分比小数，同一组的 weight 之和是1
@@ -113,18 +205,41 @@ type allocatorPicker struct {
 
 	mu sync.Mutex
 
+	serviceName string
+
 	connInfos []connInfo
 
 	config *serviceConfig
+
+	// outlier 异常副本检测，没有配置时为 nil
+	outlier *outlierDetector
+	// breakers 配置了熔断的分组的熔断器
+	breakers map[string]*circuitBreaker
+	// throttlers 配置了自适应限流的分组的限流器
+	throttlers map[string]*throttler
+	// limiters 配置了限速或并发限制的分组的限制器
+	limiters map[string]*groupLimiter
+	// builder 创建该 picker 的 ccPickerBuilder，用于排队后确认 picker 没有被替换
+	builder *ccPickerBuilder
+	// pickRate 该服务的选择次数，创建 picker 时取出，Pick 时不再查找 pickRates
+	pickRate *monitor.WindowCounter
 }
 
 func (p *allocatorPicker) Pick(pickInfo balancer.PickInfo) (balancer.PickResult, error) {
 	p.mu.Lock()
 	var groupingField = make(map[string][]string)
+	var callID string
 	// 从 gRPC context 中提取 metadata
 	md, ok := metadata.FromOutgoingContext(pickInfo.Ctx)
 	if ok {
 		for key, values := range md {
+			// 调用 ID 只用于重试时避开失败的连接，不参与分组匹配
+			if key == CallIDKey {
+				if len(values) > 0 {
+					callID = values[0]
+				}
+				continue
+			}
 			if len(values) > 0 {
 				groupingField[key] = append(groupingField[key], values...)
 			}
@@ -134,13 +249,58 @@ func (p *allocatorPicker) Pick(pickInfo balancer.PickInfo) (balancer.PickResult,
 	// 计数器记录该次请求，现在先不在这里实现计数
 	//countRequest(groupingField)
 
-	// 获取所有候选者连接
-	candidates := p.selectConn(groupingField)
-	// 从候选者连接中，选择一个连接
-	sc := p.pickOneConn(candidates)
+	// 从候选者连接中，选择一个连接，分组配置了配额时同时获取配额，排队时按优先级公平调度
+	var priority *priorityConfig
+	if p.config != nil {
+		priority = p.config.Priority
+	}
+	class, weight := priority.classify(md, pickInfo.FullMethodName)
+	index, limiter, err := p.pickWithLimit(pickInfo.Ctx, func() ([]connInfo, error) {
+		return p.candidates(groupingField, callID)
+	}, class, weight)
+	if err != nil {
+		p.mu.Unlock()
+		return balancer.PickResult{}, err
+	}
+	ci := p.connInfos[index]
+	breaker := p.breakers[ci.group]
+	if breaker != nil {
+		breaker.onPick()
+	}
+	throttle := p.throttlers[ci.group]
 
 	p.mu.Unlock()
-	return balancer.PickResult{SubConn: sc}, nil
+
+	picksTotal.WithLabelValues(p.serviceName, ci.group, ci.addr).Inc()
+	p.pickRate.IncrementOfValue(ci.addr)
+
+	// 调用方需要知道选择结果时（如追踪），记录到 context 中的 PickReport
+	if r := PickReportFromContext(pickInfo.Ctx); r != nil {
+		r.set(p.serviceName, ci.group, ci.addr)
+	}
+
+	var done func(balancer.DoneInfo)
+	if callID != "" || p.outlier != nil || breaker != nil || throttle != nil || limiter != nil {
+		outlier := p.outlier
+		done = func(info balancer.DoneInfo) {
+			if callID != "" && info.Err != nil {
+				retryRecorder.record(callID, ci.addr)
+			}
+			if outlier != nil {
+				outlier.record(ci.addr, info.Err)
+			}
+			if breaker != nil {
+				breaker.record(info.Err)
+			}
+			if throttle != nil {
+				throttle.record(!isBackendReject(info.Err))
+			}
+			if limiter != nil {
+				limiter.release()
+			}
+		}
+	}
+	return balancer.PickResult{SubConn: ci.sc, Done: done}, nil
 }
 
 // selectConn 返回一组可选择的连接
@@ -201,9 +361,34 @@ func (p *allocatorPicker) getGroupConn(groupName string) []connInfo {
 	return candidates
 }
 
-// pickOneConn 选择一个连接，挑选 load 最小的
+// candidates 返回本次调用的候选连接：匹配分组后去掉熔断、限流、被摘除以及这次调用已经失败过的连接
+func (p *allocatorPicker) candidates(groupingField map[string][]string, callID string) ([]connInfo, error) {
+	// 获取所有候选者连接
+	candidates := p.selectConn(groupingField)
+	// 去掉熔断分组的连接，分组全部熔断时快速失败
+	candidates, err := p.breakerFilter(candidates)
+	if err != nil {
+		return nil, err
+	}
+	// 后端大量拒绝请求时，按概率在本地拒绝
+	candidates, err = p.throttleFilter(candidates)
+	if err != nil {
+		return nil, err
+	}
+	// 去掉被摘除的异常副本
+	if p.outlier != nil {
+		candidates = p.outlier.filter(candidates)
+	}
+	// 重试时避开这次调用已经失败过的连接，仍然在同一分组中选择
+	if callID != "" {
+		candidates = excludeFailed(candidates, retryRecorder.failed(callID))
+	}
+	return candidates, nil
+}
+
+// minLoadConn 挑选 load 最小的连接，返回其在 connInfos 中的下标，不更新 load，选中后由 addLoad 更新
 // 用轮询算法可能有问题，因为遍历 map 每次都是无序的，没有固定的顺序。因此同一种请求，返回的 candidates 列表也可能顺序不同
-func (p *allocatorPicker) pickOneConn(candidates []connInfo) balancer.SubConn {
+func (p *allocatorPicker) minLoadConn(candidates []connInfo) int {
 	// 初始化最小 load 和对应的元素下标
 	minLoad := candidates[0].load
 	minLoadIndex := 0
@@ -216,10 +401,12 @@ func (p *allocatorPicker) pickOneConn(candidates []connInfo) balancer.SubConn {
 		}
 	}
 
-	// 更新 load，load += 1 / weight
 	// 获取目标在 connInfos 中的下标
-	index := candidates[minLoadIndex].index
+	return candidates[minLoadIndex].index
+}
 
+// addLoad 更新选中连接的 load，load += 1 / weight
+func (p *allocatorPicker) addLoad(index int) {
 	// 多一层判断，如果未初始化则默认为1。如果走到这层逻辑，则前面可能有错误
 	w := p.connInfos[index].weight
 	if w == -1 || w == 0 {
@@ -227,8 +414,6 @@ func (p *allocatorPicker) pickOneConn(candidates []connInfo) balancer.SubConn {
 	}
 	// 这里用 0.1 / w，防止 load 增长太快溢出，但 float64 不太可能溢出
 	p.connInfos[index].load += 0.1 / w
-
-	return p.connInfos[index].sc
 }
 
 // 一个请求的 metadata 中，每个 key 的每个 value 都会被记录一次
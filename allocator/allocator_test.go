@@ -4,12 +4,20 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/Chen-Jin-yuan/grpc/monitor"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -737,3 +745,900 @@ func TestFirstAllocateAll(t *testing.T) {
 
 	pb.Build(base.PickerBuildInfo{ReadySCs: rdCs})
 }
+
+// 测试分组配置 labels 时，只有标签匹配的副本分配到该分组
+func TestLabelsAllocate(t *testing.T) {
+	cis := []connInfo{
+		{addr: "1.0.0.1:1", weight: -1, labels: map[string]string{"version": "v1"}},
+		{addr: "1.0.0.1:2", weight: -1, labels: map[string]string{"version": "v2"}},
+		{addr: "1.0.0.1:3", weight: -1, labels: map[string]string{"version": "v1"}},
+		{addr: "1.0.0.1:4", weight: -1, labels: map[string]string{"version": "v2"}},
+	}
+	sc := serviceConfig{Group: map[string]groupInfo{
+		"group1": {Number: 2, Labels: map[string]string{"version": "v2"}},
+		"group2": {Number: 1},
+	}}
+
+	newAddr := addrAllocate(cis, &sc)
+	fmt.Printf("labels allocate, newAddr: %+v, cis: %+v\n", newAddr, cis)
+	if g := (*newAddr)["group1"].Addresses; len(g) != 2 || g[0] != "1.0.0.1:2" || g[1] != "1.0.0.1:4" {
+		t.Errorf("group1 should hold the v2 replicas, got %v", g)
+	}
+	if g := (*newAddr)["group2"].Addresses; len(g) != 1 || g[0] != "1.0.0.1:1" {
+		t.Errorf("group2 should hold the first unassigned replica, got %v", g)
+	}
+	if g := (*newAddr)[defaultGroupName].Addresses; len(g) != 1 || g[0] != "1.0.0.1:3" {
+		t.Errorf("notGrouped should hold the rest, got %v", g)
+	}
+}
+
+// 测试 Pick 把选择结果写入 context 中的 PickReport
+func TestPickReport(t *testing.T) {
+	rdCs := make(map[balancer.SubConn]base.SubConnInfo)
+	rdCs[&subC{id: 1}] = base.SubConnInfo{Address: resolver.Address{Addr: "1.0.0.1:1", ServerName: "exam_svc"}}
+	rdCs[&subC{id: 2}] = base.SubConnInfo{Address: resolver.Address{Addr: "1.0.0.2:1", ServerName: "exam_svc"}}
+
+	pb := allocatorPickerBuilder{"./example_config.json", 10001}
+	p := pb.Build(base.PickerBuildInfo{ReadySCs: rdCs})
+
+	ctx, report := NewPickReportContext(context.Background())
+	if _, err := p.Pick(balancer.PickInfo{FullMethodName: "hello", Ctx: ctx}); err != nil {
+		t.Fatalf("Pick err: %v", err)
+	}
+	service, group, addr := report.Get()
+	fmt.Printf("pick report: service: %s, group: %s, addr: %s\n", service, group, addr)
+	if service != "exam_svc" || group == "" || addr == "" {
+		t.Errorf("pick report not filled: %s, %s, %s", service, group, addr)
+	}
+	if _, r := NewPickReportContext(ctx); r != report {
+		t.Errorf("NewPickReportContext should reuse the report in ctx")
+	}
+}
+
+// 同一次调用失败后重试，不会再选择失败过的连接，且仍在同一分组内
+func TestRetryAvoidFailed(t *testing.T) {
+	rdCs := make(map[balancer.SubConn]base.SubConnInfo)
+	for i := 1; i <= 7; i++ {
+		rdCs[&subC{id: i}] = base.SubConnInfo{Address: resolver.Address{Addr: fmt.Sprintf("1.0.0.%d:1", i), ServerName: "exam_svc"}}
+	}
+	pb := allocatorPickerBuilder{"./example_config.json", 10001}
+	p := pb.Build(base.PickerBuildInfo{ReadySCs: rdCs})
+
+	md := metadata.Pairs("request-type", "v1", "method-type", "v1", CallIDKey, "call-1")
+	ctx, report := NewPickReportContext(metadata.NewOutgoingContext(context.Background(), md))
+
+	failed := make(map[string]bool)
+	var group string
+	for attempt := 0; attempt < 3; attempt++ {
+		res, err := p.Pick(balancer.PickInfo{FullMethodName: "hello", Ctx: ctx})
+		if err != nil {
+			t.Fatalf("Pick err: %v", err)
+		}
+		_, g, addr := report.Get()
+		fmt.Printf("attempt %d pick group: %s, addr: %s\n", attempt, g, addr)
+		if failed[addr] {
+			t.Errorf("attempt %d picked failed addr %s again", attempt, addr)
+		}
+		if group != "" && g != group {
+			t.Errorf("retry left group %s for %s", group, g)
+		}
+		group = g
+		failed[addr] = true
+		res.Done(balancer.DoneInfo{Err: fmt.Errorf("unavailable")})
+	}
+
+	// 分组内的连接都失败过，仍然在分组内选择
+	if _, err := p.Pick(balancer.PickInfo{FullMethodName: "hello", Ctx: ctx}); err != nil {
+		t.Fatalf("Pick err: %v", err)
+	}
+	if _, g, _ := report.Get(); g != group {
+		t.Errorf("expect group %s after all failed, got %s", group, g)
+	}
+}
+
+// buildTestPicker 把配置写入临时文件，用 n 个服务 svc 的连接构建 picker，同时返回 builder 和连接用于重建
+func buildTestPicker(t *testing.T, svc, config string, n int) (balancer.V2Picker, allocatorPickerBuilder, map[balancer.SubConn]base.SubConnInfo) {
+	t.Helper()
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatalf("write config err: %v", err)
+	}
+	// picker 会把分组结果写到当前目录下的 svc.json
+	t.Cleanup(func() { os.Remove(svc + ".json") })
+
+	rdCs := make(map[balancer.SubConn]base.SubConnInfo)
+	for i := 1; i <= n; i++ {
+		rdCs[&subC{id: i}] = base.SubConnInfo{Address: resolver.Address{Addr: fmt.Sprintf("1.0.0.%d:1", i), ServerName: svc}}
+	}
+	pb := allocatorPickerBuilder{configPath, 10001}
+	return pb.Build(base.PickerBuildInfo{ReadySCs: rdCs}), pb, rdCs
+}
+
+// 连续失败的副本被摘除，分组摘除数量有上限，摘除时间按次数翻倍
+func TestOutlierDetection(t *testing.T) {
+	config := `{"outlier_svc": {"group": {"group1": {"number": 4}},
+		"outlierDetection": {"consecutiveErrors": 3, "baseEjectionSeconds": 10, "maxEjectionSeconds": 30, "maxEjectionPercent": 50}}}`
+	bp, pb, rdCs := buildTestPicker(t, "outlier_svc", config, 4)
+	p := bp.(*allocatorPicker)
+
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+	fail := func(addr string, n int) {
+		for i := 0; i < n; i++ {
+			p.outlier.record(addr, unavailable)
+		}
+	}
+	// 业务错误不算副本异常
+	fail("1.0.0.1:1", 2)
+	p.outlier.record("1.0.0.1:1", status.Error(codes.NotFound, "not found"))
+	fail("1.0.0.1:1", 2)
+	if _, hosts, _ := outlierSnapshot("outlier_svc"); hosts["1.0.0.1:1"].Ejected {
+		t.Errorf("1.0.0.1:1 should not be ejected, errors are not consecutive")
+	}
+	fail("1.0.0.1:1", 1)
+	fail("1.0.0.2:1", 3)
+	fail("1.0.0.3:1", 3)
+
+	_, hosts, ok := outlierSnapshot("outlier_svc")
+	fmt.Printf("outlier hosts: %+v\n", hosts)
+	if !ok || !hosts["1.0.0.1:1"].Ejected || !hosts["1.0.0.2:1"].Ejected {
+		t.Fatalf("1.0.0.1:1 and 1.0.0.2:1 should be ejected")
+	}
+	if hosts["1.0.0.3:1"].Ejected {
+		t.Errorf("at most 50%% of group1 can be ejected")
+	}
+
+	// 被摘除的副本不会被选中，picker 重建后状态保留
+	p = pb.Build(base.PickerBuildInfo{ReadySCs: rdCs}).(*allocatorPicker)
+	ctx, report := NewPickReportContext(context.Background())
+	for i := 0; i < 10; i++ {
+		if _, err := p.Pick(balancer.PickInfo{FullMethodName: "hello", Ctx: ctx}); err != nil {
+			t.Fatalf("Pick err: %v", err)
+		}
+		if _, _, addr := report.Get(); addr == "1.0.0.1:1" || addr == "1.0.0.2:1" {
+			t.Errorf("picked ejected addr %s", addr)
+		}
+	}
+
+	// 摘除时间到了恢复，再次摘除时时间翻倍
+	p.outlier.mu.Lock()
+	p.outlier.hosts["1.0.0.1:1"].EjectedUntil = time.Now().Add(-time.Second)
+	p.outlier.mu.Unlock()
+	fail("1.0.0.1:1", 3)
+	_, hosts, _ = outlierSnapshot("outlier_svc")
+	h := hosts["1.0.0.1:1"]
+	fmt.Printf("1.0.0.1:1 ejected again: %+v\n", h)
+	if !h.Ejected || h.EjectionCount != 2 || time.Until(h.EjectedUntil) < 15*time.Second {
+		t.Errorf("second ejection should last 20s, got %+v", h)
+	}
+
+	rec := httptest.NewRecorder()
+	getOutlierInfo(rec, httptest.NewRequest("GET", "/outlier?name=outlier_svc", nil))
+	fmt.Printf("GET /outlier: %d %s\n", rec.Code, rec.Body.String())
+	if rec.Code != 200 {
+		t.Errorf("unexpected status %d", rec.Code)
+	}
+}
+
+// 分组连续失败后熔断，熔断时转发到备用分组或快速失败，半开探测成功后恢复
+func TestCircuitBreaker(t *testing.T) {
+	clock := time.Now()
+	breakerNow = func() time.Time { return clock }
+	defer func() { breakerNow = time.Now }()
+
+	config := `{"breaker_svc": {"group": {
+		"group1": {"number": 2, "selector": {"request-type": "v1"},
+			"circuitBreaker": {"consecutiveFailures": 2, "openSeconds": 30, "fallbackGroup": "group2"}},
+		"group2": {"number": 2, "selector": {"request-type": "v2"}}}}}`
+	p, _, _ := buildTestPicker(t, "breaker_svc", config, 4)
+
+	ctx, report := NewPickReportContext(metadata.NewOutgoingContext(context.Background(), metadata.Pairs("request-type", "v1")))
+	pick := func(err error) (string, error) {
+		res, pickErr := p.Pick(balancer.PickInfo{FullMethodName: "hello", Ctx: ctx})
+		if pickErr != nil {
+			return "", pickErr
+		}
+		_, group, _ := report.Get()
+		if res.Done != nil {
+			res.Done(balancer.DoneInfo{Err: err})
+		}
+		return group, nil
+	}
+
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+	for i := 0; i < 2; i++ {
+		if g, err := pick(unavailable); err != nil || g != "group1" {
+			t.Fatalf("expect group1 before open, got %s, %v", g, err)
+		}
+	}
+	statuses, _ := breakerSnapshot("breaker_svc")
+	fmt.Printf("breaker status: %+v\n", statuses)
+	if statuses["group1"].State != "open" {
+		t.Fatalf("group1 should be open")
+	}
+	if g, err := pick(nil); err != nil || g != "group2" {
+		t.Errorf("expect fallback to group2, got %s, %v", g, err)
+	}
+
+	// 没有备用分组时快速失败
+	b := p.(*allocatorPicker).breakers["group1"]
+	b.mu.Lock()
+	b.config.FallbackGroup = ""
+	b.mu.Unlock()
+	_, err := pick(nil)
+	fmt.Printf("pick when open: %v\n", err)
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("expect Unavailable when open, got %v", err)
+	}
+
+	// 半开状态只放行一个探测请求，探测成功后恢复
+	clock = clock.Add(31 * time.Second)
+	res, err := p.Pick(balancer.PickInfo{FullMethodName: "hello", Ctx: ctx})
+	if err != nil {
+		t.Fatalf("half-open probe should pass: %v", err)
+	}
+	if _, err = pick(nil); err == nil {
+		t.Errorf("only one probe is allowed when half-open")
+	}
+	res.Done(balancer.DoneInfo{})
+	if g, err := pick(nil); err != nil || g != "group1" {
+		t.Errorf("expect group1 after closed, got %s, %v", g, err)
+	}
+
+	rec := httptest.NewRecorder()
+	getBreakerInfo(rec, httptest.NewRequest("GET", "/breaker?name=breaker_svc", nil))
+	fmt.Printf("GET /breaker: %d %s\n", rec.Code, rec.Body.String())
+	if rec.Code != 200 {
+		t.Errorf("unexpected status %d", rec.Code)
+	}
+}
+
+// 后端拒绝大部分请求时按概率本地拒绝，后端恢复接受后不再拒绝
+func TestAdaptiveThrottle(t *testing.T) {
+	config := `{"throttle_svc": {"group": {"group1": {"number": 2, "throttle": {"k": 2, "windowSeconds": 60}}}}}`
+	p, _, _ := buildTestPicker(t, "throttle_svc", config, 2)
+
+	call := func(backendErr error) error {
+		res, err := p.Pick(balancer.PickInfo{FullMethodName: "hello", Ctx: context.Background()})
+		if err != nil {
+			return err
+		}
+		res.Done(balancer.DoneInfo{Err: backendErr})
+		return nil
+	}
+
+	// 后端拒绝所有请求
+	overloaded := status.Error(codes.ResourceExhausted, "overloaded")
+	rejected := 0
+	for i := 0; i < 200; i++ {
+		if err := call(overloaded); err != nil {
+			if status.Code(err) != codes.ResourceExhausted {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			rejected++
+		}
+	}
+	fmt.Printf("throttled %d of 200 requests while backend rejecting\n", rejected)
+	if rejected < 100 {
+		t.Errorf("expect most requests throttled locally, got %d", rejected)
+	}
+
+	// 后端恢复，接受数足够后不再本地拒绝
+	tr := p.(*allocatorPicker).throttlers["group1"]
+	for i := 0; i < 200; i++ {
+		tr.record(true)
+	}
+	requests, accepts := tr.counts(time.Now())
+	fmt.Printf("requests: %d, accepts: %d, reject probability: %.3f\n", requests, accepts, tr.rejectProbability(time.Now()))
+	for i := 0; i < 50; i++ {
+		if err := call(nil); err != nil {
+			t.Fatalf("request should not be throttled after backend recovered: %v", err)
+		}
+	}
+}
+
+// 分组并发数达到上限时，fail 模式返回 RESOURCE_EXHAUSTED，queue 模式等待请求完成或 context 结束
+func TestGroupLimit(t *testing.T) {
+	config := `{"limit_svc": {"group": {
+		"group1": {"number": 1, "selector": {"tenant": "a"}, "maxConcurrent": 2},
+		"group2": {"number": 1, "selector": {"tenant": "b"}, "maxConcurrent": 1, "limitMode": "queue"},
+		"group3": {"number": 1, "selector": {"tenant": "c"}, "maxQPS": 10, "burst": 2}}}}`
+	p, _, _ := buildTestPicker(t, "limit_svc", config, 3)
+	tenant := func(ctx context.Context, name string) context.Context {
+		return metadata.NewOutgoingContext(ctx, metadata.Pairs("tenant", name))
+	}
+
+	// group1 并发数 2，第三个请求失败，完成一个后恢复
+	var dones []func(balancer.DoneInfo)
+	for i := 0; i < 2; i++ {
+		res, err := p.Pick(balancer.PickInfo{Ctx: tenant(context.Background(), "a")})
+		if err != nil {
+			t.Fatalf("Pick err: %v", err)
+		}
+		dones = append(dones, res.Done)
+	}
+	_, err := p.Pick(balancer.PickInfo{Ctx: tenant(context.Background(), "a")})
+	fmt.Printf("group1 over concurrency: %v\n", err)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expect ResourceExhausted, got %v", err)
+	}
+	dones[0](balancer.DoneInfo{})
+	if _, err = p.Pick(balancer.PickInfo{Ctx: tenant(context.Background(), "a")}); err != nil {
+		t.Errorf("expect pass after release, got %v", err)
+	}
+
+	// group2 queue 模式，等待第一个请求完成
+	res, err := p.Pick(balancer.PickInfo{Ctx: tenant(context.Background(), "b")})
+	if err != nil {
+		t.Fatalf("Pick err: %v", err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		res.Done(balancer.DoneInfo{})
+	}()
+	start := time.Now()
+	if _, err = p.Pick(balancer.PickInfo{Ctx: tenant(context.Background(), "b")}); err != nil {
+		t.Errorf("queued pick err: %v", err)
+	}
+	fmt.Printf("group2 queued for %v\n", time.Since(start))
+	if time.Since(start) < 40*time.Millisecond {
+		t.Errorf("queued pick should wait for release")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	_, err = p.Pick(balancer.PickInfo{Ctx: tenant(ctx, "b")})
+	fmt.Printf("group2 queued until deadline: %v\n", err)
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("expect DeadlineExceeded, got %v", err)
+	}
+
+	// group3 令牌桶 burst 2，连续第三个请求失败
+	for i := 0; i < 3; i++ {
+		res, err := p.Pick(balancer.PickInfo{Ctx: tenant(context.Background(), "c")})
+		if i < 2 && err != nil {
+			t.Errorf("request %d within burst err: %v", i, err)
+		}
+		if i == 2 && status.Code(err) != codes.ResourceExhausted {
+			t.Errorf("expect ResourceExhausted over burst, got %v", err)
+		}
+		if err == nil {
+			res.Done(balancer.DoneInfo{})
+		}
+	}
+}
+
+// 分组并发数满时调用按先进先出排队，队列长度有上限，排队数通过 /counter 的 waiting_requests 查看
+func TestWaitingQueue(t *testing.T) {
+	config := `{"queue_svc": {"group": {"group1": {"number": 2, "maxConcurrent": 1, "limitMode": "queue", "maxQueue": 2}}}}`
+	p, _, _ := buildTestPicker(t, "queue_svc", config, 2)
+
+	first, err := p.Pick(balancer.PickInfo{Ctx: context.Background()})
+	if err != nil {
+		t.Fatalf("Pick err: %v", err)
+	}
+
+	// 两个调用依次排队
+	picked := make(chan int, 2)
+	dones := make(chan func(balancer.DoneInfo), 2)
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			res, err := p.Pick(balancer.PickInfo{Ctx: context.Background()})
+			if err != nil {
+				t.Errorf("queued pick %d err: %v", i, err)
+				return
+			}
+			picked <- i
+			dones <- res.Done
+		}(i)
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// 队列已满
+	_, err = p.Pick(balancer.PickInfo{Ctx: context.Background()})
+	fmt.Printf("pick when queue full: %v\n", err)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expect ResourceExhausted when queue is full, got %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	getCounterInfo(rec, httptest.NewRequest("GET", "/counter?name=queue_svc", nil))
+	fmt.Printf("GET /counter: %s\n", rec.Body.String())
+	var counter map[string]map[string]map[string]int
+	if err = json.Unmarshal(rec.Body.Bytes(), &counter); err != nil {
+		t.Fatalf("unmarshal counter err: %v", err)
+	}
+	if counter["waiting_requests"]["queue_svc"]["group1"] != 2 || counter["out_ready_requests"]["queue_svc"]["group1"] != 1 {
+		t.Errorf("unexpected counter: %v", counter)
+	}
+
+	// 请求完成后按排队顺序放行
+	first.Done(balancer.DoneInfo{})
+	if i := <-picked; i != 0 {
+		t.Errorf("expect the first queued call to be released first, got %d", i)
+	}
+	(<-dones)(balancer.DoneInfo{})
+	if i := <-picked; i != 1 {
+		t.Errorf("expect the second queued call to be released next, got %d", i)
+	}
+	(<-dones)(balancer.DoneInfo{})
+
+	// context 结束的调用离开队列
+	hold, _ := p.Pick(balancer.PickInfo{Ctx: context.Background()})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = p.Pick(balancer.PickInfo{Ctx: ctx})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("expect DeadlineExceeded, got %v", err)
+	}
+	hold.Done(balancer.DoneInfo{})
+	if requests := limiterSnapshot("queue_svc")["queue_svc"]["group1"]; requests.Waiting != 0 || requests.Inflight != 0 {
+		t.Errorf("unexpected requests after all done: %+v", requests)
+	}
+}
+
+// 连接移除后，picksTotal 中该连接的序列被删除
+func TestPicksTotalCleanup(t *testing.T) {
+	config := `{"metrics_svc": {"group": {"group1": {"number": 2}}}}`
+	p, pb, rdCs := buildTestPicker(t, "metrics_svc", config, 2)
+	for i := 0; i < 4; i++ {
+		if _, err := p.Pick(balancer.PickInfo{Ctx: context.Background()}); err != nil {
+			t.Fatalf("Pick err: %v", err)
+		}
+	}
+	before := testutil.CollectAndCount(picksTotal)
+
+	for sc, info := range rdCs {
+		if info.Address.Addr == "1.0.0.2:1" {
+			delete(rdCs, sc)
+		}
+	}
+	pb.Build(base.PickerBuildInfo{ReadySCs: rdCs})
+	after := testutil.CollectAndCount(picksTotal)
+	fmt.Printf("picksTotal series before: %d, after: %d\n", before, after)
+	if after != before-1 {
+		t.Errorf("expect the series of the removed conn to be deleted, before %d after %d", before, after)
+	}
+}
+
+// 排队的调用拿到配额后按当前的 load 选择连接；picker 被替换后返回 ErrNoSubConnAvailable 由 grpc 重新选择
+func TestQueuedPickRevalidate(t *testing.T) {
+	config := `{"requeue_svc": {"group": {"group1": {"number": 2, "maxConcurrent": 2, "limitMode": "queue"}}}}`
+	_, pb, rdCs := buildTestPicker(t, "requeue_svc", config, 2)
+	cb := &ccPickerBuilder{allocatorPickerBuilder: pb}
+	p := cb.Build(base.PickerBuildInfo{ReadySCs: rdCs})
+
+	var holds []func(balancer.DoneInfo)
+	for i := 0; i < 2; i++ {
+		res, err := p.Pick(balancer.PickInfo{Ctx: context.Background()})
+		if err != nil {
+			t.Fatalf("Pick err: %v", err)
+		}
+		holds = append(holds, res.Done)
+	}
+
+	type result struct {
+		res balancer.PickResult
+		err error
+	}
+	resultC := make(chan result, 2)
+	pick := func() {
+		go func() {
+			res, err := p.Pick(balancer.PickInfo{Ctx: context.Background()})
+			resultC <- result{res, err}
+		}()
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// 两个排队的调用依次放行，第二个调用应该看到第一个调用增加的 load，选择另一个连接
+	pick()
+	pick()
+	holds[0](balancer.DoneInfo{})
+	r1 := <-resultC
+	holds[1](balancer.DoneInfo{})
+	r2 := <-resultC
+	if r1.err != nil || r2.err != nil {
+		t.Fatalf("queued pick err: %v %v", r1.err, r2.err)
+	}
+	fmt.Printf("queued picks: %v %v\n", r1.res.SubConn, r2.res.SubConn)
+	if r1.res.SubConn == r2.res.SubConn {
+		t.Errorf("queued calls should be spread over both conns, both got %v", r1.res.SubConn)
+	}
+
+	// 排队期间 picker 被替换，放行后不使用旧 picker，配额归还
+	pick()
+	cb.Build(base.PickerBuildInfo{ReadySCs: rdCs})
+	r1.res.Done(balancer.DoneInfo{})
+	r3 := <-resultC
+	fmt.Printf("queued pick after rebuild: %v\n", r3.err)
+	if r3.err != balancer.ErrNoSubConnAvailable {
+		t.Errorf("expect ErrNoSubConnAvailable after picker rebuilt, got %v", r3.err)
+	}
+	r2.res.Done(balancer.DoneInfo{})
+	if requests := limiterSnapshot("requeue_svc")["requeue_svc"]["group1"]; requests.Waiting != 0 || requests.Inflight != 0 {
+		t.Errorf("unexpected requests after all done: %+v", requests)
+	}
+}
+
+// 分组排队时不同优先级按权重公平放行，大量 batch 调用不会让 interactive 调用一直等待
+func TestPriorityQueue(t *testing.T) {
+	config := `{"priority_svc": {"group": {"group1": {"number": 1, "maxConcurrent": 1, "limitMode": "queue"}},
+		"priority": {"classes": {"interactive": 3, "batch": 1}, "default": "interactive", "methods": {"/svc/Export": "batch"}}}}`
+	p, _, _ := buildTestPicker(t, "priority_svc", config, 1)
+
+	class, _ := p.(*allocatorPicker).config.Priority.classify(metadata.MD{}, "/svc/Export")
+	if class != "batch" {
+		t.Errorf("expect /svc/Export to be batch, got %s", class)
+	}
+
+	hold, err := p.Pick(balancer.PickInfo{Ctx: context.Background()})
+	if err != nil {
+		t.Fatalf("Pick err: %v", err)
+	}
+
+	type released struct {
+		class string
+		done  func(balancer.DoneInfo)
+	}
+	releasedC := make(chan released, 16)
+	enqueue := func(class string) {
+		ctx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs("priority", class))
+		go func() {
+			res, err := p.Pick(balancer.PickInfo{Ctx: ctx})
+			if err != nil {
+				t.Errorf("queued pick err: %v", err)
+				return
+			}
+			releasedC <- released{class: class, done: res.Done}
+		}()
+		time.Sleep(5 * time.Millisecond)
+	}
+	// batch 调用先排队
+	for i := 0; i < 8; i++ {
+		enqueue("batch")
+	}
+	for i := 0; i < 8; i++ {
+		enqueue("interactive")
+	}
+
+	hold.Done(balancer.DoneInfo{})
+	var order []string
+	for i := 0; i < 16; i++ {
+		r := <-releasedC
+		order = append(order, r.class)
+		r.done(balancer.DoneInfo{})
+	}
+	fmt.Printf("release order: %v\n", order)
+	interactive := 0
+	for _, c := range order[:8] {
+		if c == "interactive" {
+			interactive++
+		}
+	}
+	if interactive < 5 {
+		t.Errorf("expect interactive calls to get about 3/4 of the first releases, got %d of 8", interactive)
+	}
+
+	// 不在配置中的优先级按默认优先级处理，队列清空后不保留各优先级的队列和权重
+	if class, _ = p.(*allocatorPicker).config.Priority.classify(metadata.Pairs("priority", "made-up"), "/svc/Export"); class != "interactive" {
+		t.Errorf("expect unknown class to fall back to interactive, got %s", class)
+	}
+	l := p.(*allocatorPicker).limiters["group1"]
+	l.mu.Lock()
+	fmt.Printf("limiter state after drain: waiters %v, weights %v, pass %v\n", l.waiters, l.weights, l.pass)
+	if len(l.waiters) != 0 || len(l.weights) != 0 || len(l.pass) > 2 {
+		t.Errorf("unexpected limiter state after drain: %v %v %v", l.waiters, l.weights, l.pass)
+	}
+	l.mu.Unlock()
+}
+
+// 两个副本返回相同的数据，另一个副本无法连接
+func TestAggregate(t *testing.T) {
+	rcs := monitor.NewRequestCounters()
+	rcs.GetCounter("request-type").IncrementOfValue("v1")
+	rcs.GetCounter("request-type").IncrementOfValue("v2")
+	SetRequestCounters(rcs)
+	defer SetRequestCounters(nil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/svc-info", getSvcConfig)
+	mux.HandleFunc("/counter", getCounterInfo)
+	mux.HandleFunc("/request-counters", getRequestCounters)
+	peer1, peer2 := httptest.NewServer(mux), httptest.NewServer(mux)
+	defer peer1.Close()
+	defer peer2.Close()
+	// 第三个副本返回无法合并的快照
+	badMux := http.NewServeMux()
+	badMux.HandleFunc("/svc-info", getSvcConfig)
+	badMux.HandleFunc("/counter", getCounterInfo)
+	badMux.HandleFunc("/request-counters", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"entries": [{"key": "request-type", "keyKind": "float", "value": "v1", "valueKind": "string", "count": 5}]}`))
+	})
+	peer3 := httptest.NewServer(badMux)
+	defer peer3.Close()
+	EnablePeerAggregation(func() ([]string, error) {
+		return []string{peer1.Listener.Addr().String(), peer2.Listener.Addr().String(), peer3.Listener.Addr().String(), "127.0.0.1:1"}, nil
+	})
+	defer EnablePeerAggregation(nil)
+
+	rec := httptest.NewRecorder()
+	getAggregateInfo(rec, httptest.NewRequest("GET", "/aggregate?name=exam_svc", nil))
+	fmt.Printf("GET /aggregate: %s\n", rec.Body.String())
+	var result struct {
+		Replicas map[string]replicaInfo `json:"replicas"`
+		Total    aggregateInfo          `json:"total"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("unmarshal aggregate err: %v", err)
+	}
+	if result.Total.Replicas != 4 || result.Total.Failed != 2 {
+		t.Errorf("expect 4 replicas with 2 failed, got %+v", result.Total)
+	}
+	if result.Total.RequestCounters["request-type"]["v1"] != 2 {
+		t.Errorf("expect merged count 2, got %v", result.Total.RequestCounters)
+	}
+	replica := result.Replicas[peer1.Listener.Addr().String()]
+	if replica.SvcInfo == nil || replica.RequestCounters["request-type"]["v2"] != 1 {
+		t.Errorf("unexpected replica info: %+v", replica)
+	}
+	if result.Replicas["127.0.0.1:1"].Error == "" {
+		t.Errorf("expect error for unreachable replica")
+	}
+	if e := result.Replicas[peer3.Listener.Addr().String()].Error; !strings.Contains(e, "merge request counters") {
+		t.Errorf("expect merge error for replica with bad snapshot, got %q", e)
+	}
+}
+
+// 管理接口返回内存中 picker 的状态，配置修改后版本变化
+func TestAdminAPI(t *testing.T) {
+	config := `{"admin_svc": {"group": {"group1": {"number": 1, "selector": {"request-type": "v1"}}, "group2": {"number": 2, "selector": {"request-type": "v2"}}}}}`
+	p, pb, rdCs := buildTestPicker(t, "admin_svc", config, 3)
+	res, err := p.Pick(balancer.PickInfo{Ctx: metadata.AppendToOutgoingContext(context.Background(), "request-type", "v1")})
+	if err != nil {
+		t.Fatalf("Pick err: %v", err)
+	}
+	if res.Done != nil {
+		res.Done(balancer.DoneInfo{})
+	}
+
+	// 使用调用方的 mux
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	get := func(path string, v interface{}) int {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		fmt.Printf("GET %s: %s\n", path, rec.Body.String())
+		if rec.Code == http.StatusOK && v != nil {
+			if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+				t.Fatalf("unmarshal %s err: %v", path, err)
+			}
+		}
+		return rec.Code
+	}
+
+	var services struct {
+		APIVersion string         `json:"apiVersion"`
+		Services   []adminService `json:"services"`
+	}
+	get("/v1/services", &services)
+	var svc *adminService
+	for i := range services.Services {
+		if services.Services[i].Name == "admin_svc" {
+			svc = &services.Services[i]
+		}
+	}
+	if services.APIVersion != "v1" || svc == nil || svc.Conns != 3 || svc.Groups != 2 || svc.ConfigVersion == "" {
+		t.Fatalf("unexpected services: %+v", services)
+	}
+
+	var groups struct {
+		Groups []adminGroup `json:"groups"`
+	}
+	get("/v1/services/admin_svc/groups", &groups)
+	if len(groups.Groups) != 2 || groups.Groups[0].Name != "group1" || len(groups.Groups[0].Addrs) != 1 || len(groups.Groups[1].Addrs) != 2 {
+		t.Errorf("unexpected groups: %+v", groups)
+	}
+
+	var conns struct {
+		Conns []adminConn `json:"conns"`
+	}
+	get("/v1/services/admin_svc/conns", &conns)
+	var loaded int
+	for _, c := range conns.Conns {
+		if c.Load > 0 {
+			loaded++
+			if c.Group != "group1" {
+				t.Errorf("expect picked conn in group1, got %+v", c)
+			}
+		}
+	}
+	if len(conns.Conns) != 3 || loaded != 1 {
+		t.Errorf("unexpected conns: %+v", conns)
+	}
+
+	if code := get("/v1/services/unknown/conns", nil); code != http.StatusNotFound {
+		t.Errorf("expect 404 for unknown service, got %d", code)
+	}
+	if code := get("/v1/services/admin_svc/other", nil); code != http.StatusNotFound {
+		t.Errorf("expect 404 for unknown resource, got %d", code)
+	}
+
+	// 修改配置后重建 picker，版本变化
+	config = `{"admin_svc": {"group": {"group1": {"number": 2}, "group2": {"number": 1}}}}`
+	if err = os.WriteFile(pb.allocatorConfigPath, []byte(config), 0644); err != nil {
+		t.Fatalf("write config err: %v", err)
+	}
+	pb.Build(base.PickerBuildInfo{ReadySCs: rdCs})
+	if v := getPickerState("admin_svc").configVersion; v == svc.ConfigVersion {
+		t.Errorf("expect config version to change, got %s", v)
+	}
+}
+
+// dashboard 预览和修改分组
+func TestDashboard(t *testing.T) {
+	config := `{"dash_svc": {"group": {"group1": {"number": 2, "selector": {"request-type": "v1"}}, "group2": {"number": 2}}}}`
+	defer SetAdminCredentials("", "")
+	p, pb, rdCs := buildTestPicker(t, "dash_svc", config, 5)
+	for i := 0; i < 4; i++ {
+		res, err := p.Pick(balancer.PickInfo{Ctx: metadata.AppendToOutgoingContext(context.Background(), "request-type", "v1")})
+		if err != nil {
+			t.Fatalf("Pick err: %v", err)
+		}
+		if res.Done != nil {
+			res.Done(balancer.DoneInfo{})
+		}
+	}
+
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	do := func(method string, path string, body string, user string, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do("GET", "/dashboard/", "", "", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "allocator dashboard") {
+		t.Errorf("unexpected dashboard page: %d", rec.Code)
+	}
+
+	// 选择速率和健康状态
+	var conns struct {
+		Conns []adminConn `json:"conns"`
+	}
+	rec = do("GET", "/v1/services/dash_svc/conns", "", "", "")
+	fmt.Printf("GET conns: %s\n", rec.Body.String())
+	_ = json.Unmarshal(rec.Body.Bytes(), &conns)
+	var rate float64
+	for _, c := range conns.Conns {
+		rate += c.PickRate
+		if c.Ejected {
+			t.Errorf("unexpected ejected conn: %+v", c)
+		}
+	}
+	if rate != 0.4 {
+		t.Errorf("expect total pick rate 0.4, got %v", rate)
+	}
+
+	edit := `{"groups": {"group1": {"number": 1}, "group2": {"number": 3, "weight": [1, 2, 1]}}}`
+	// 没有设置用户名密码时不能修改，设置后需要认证
+	if rec = do("POST", "/v1/services/dash_svc/preview", edit, "", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("expect 403 without credentials set, got %d", rec.Code)
+	}
+	SetAdminCredentials("admin", "secret")
+	if rec = do("POST", "/v1/services/dash_svc/preview", edit, "admin", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expect 401 with wrong password, got %d", rec.Code)
+	}
+	if rec = do("GET", "/v1/services/dash_svc/preview", "", "admin", "secret"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expect 405 for GET preview, got %d", rec.Code)
+	}
+	if rec = do("POST", "/v1/services/dash_svc/preview", `{"groups": {"group9": {"number": 1}}}`, "admin", "secret"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expect 400 for unknown group, got %d", rec.Code)
+	}
+
+	// 预览不修改 picker
+	type editResult struct {
+		ConfigVersion    string       `json:"configVersion"`
+		NewConfigVersion string       `json:"newConfigVersion"`
+		Groups           []adminGroup `json:"groups"`
+		Moves            []connMove   `json:"moves"`
+		Applied          bool         `json:"applied"`
+	}
+	var preview editResult
+	rec = do("POST", "/v1/services/dash_svc/preview", edit, "admin", "secret")
+	fmt.Printf("POST preview: %s\n", rec.Body.String())
+	if err := json.Unmarshal(rec.Body.Bytes(), &preview); err != nil {
+		t.Fatalf("unmarshal preview err: %v", err)
+	}
+	groupAddrs := func(groups []adminGroup) map[string]int {
+		n := make(map[string]int)
+		for _, g := range groups {
+			n[g.Name] = len(g.Addrs)
+		}
+		return n
+	}
+	if n := groupAddrs(preview.Groups); n["group1"] != 1 || n["group2"] != 3 || n["notGrouped"] != 1 || preview.Applied {
+		t.Errorf("unexpected preview groups: %+v", preview.Groups)
+	}
+	if len(preview.Moves) == 0 || preview.NewConfigVersion == preview.ConfigVersion {
+		t.Errorf("unexpected preview: %+v", preview)
+	}
+	if n := groupAddrs(p.(*allocatorPicker).groups()); n["group1"] != 2 {
+		t.Errorf("preview should not change picker, got %v", n)
+	}
+
+	// apply 需要带上预览时的配置版本，版本不一致时拒绝
+	if rec = do("POST", "/v1/services/dash_svc/apply", edit, "admin", "secret"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expect 400 for apply without configVersion, got %d", rec.Code)
+	}
+	withVersion := func(version string) string {
+		return strings.Replace(edit, `{"groups"`, `{"configVersion": "`+version+`", "groups"`, 1)
+	}
+	if rec = do("POST", "/v1/services/dash_svc/apply", withVersion("000000000000"), "admin", "secret"); rec.Code != http.StatusConflict {
+		t.Errorf("expect 409 for stale configVersion, got %d", rec.Code)
+	}
+
+	// 修改后立即生效，并写入配置文件和分组文件
+	var applied editResult
+	rec = do("POST", "/v1/services/dash_svc/apply", withVersion(preview.ConfigVersion), "admin", "secret")
+	if err := json.Unmarshal(rec.Body.Bytes(), &applied); err != nil || !applied.Applied {
+		t.Fatalf("apply failed: %s", rec.Body.String())
+	}
+	// 已经应用过的预览不能再次应用
+	if rec = do("POST", "/v1/services/dash_svc/apply", withVersion(preview.ConfigVersion), "admin", "secret"); rec.Code != http.StatusConflict {
+		t.Errorf("expect 409 for applying the same preview twice, got %d", rec.Code)
+	}
+	if n := groupAddrs(p.(*allocatorPicker).groups()); n["group1"] != 1 || n["group2"] != 3 {
+		t.Errorf("unexpected groups after apply: %v", n)
+	}
+	var weights []float64
+	for _, c := range p.(*allocatorPicker).conns() {
+		if c.Group == "group2" {
+			weights = append(weights, c.Weight)
+		}
+	}
+	fmt.Printf("group2 weights: %v\n", weights)
+	if len(weights) != 3 || weights[0]+weights[1]+weights[2] < 0.999 {
+		t.Errorf("unexpected group2 weights: %v", weights)
+	}
+	if v := getPickerState("dash_svc").configVersion; v != applied.NewConfigVersion {
+		t.Errorf("expect config version %s, got %s", applied.NewConfigVersion, v)
+	}
+
+	// 重建 picker 时读取修改后的配置，分配不变
+	oldState := getPickerState("dash_svc")
+	p = pb.Build(base.PickerBuildInfo{ReadySCs: rdCs})
+	if n := groupAddrs(p.(*allocatorPicker).groups()); n["group1"] != 1 || n["group2"] != 3 {
+		t.Errorf("unexpected groups after rebuild: %v", n)
+	}
+	if v := getPickerState("dash_svc").configVersion; v != applied.NewConfigVersion {
+		t.Errorf("expect rebuilt config version %s, got %s", applied.NewConfigVersion, v)
+	}
+
+	// 读取服务状态之后 picker 被重建，不修改已经失效的 picker
+	req := httptest.NewRequest("POST", "/v1/services/dash_svc/apply", strings.NewReader(withVersion(applied.NewConfigVersion)))
+	req.SetBasicAuth("admin", "secret")
+	rec = httptest.NewRecorder()
+	editGroups(rec, req, oldState, true)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("expect 409 when picker was rebuilt, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// 配置文件在 picker 创建之后被修改，picker 内存中还是旧配置，预览和应用都拒绝
+	changed := `{"dash_svc": {"group": {"group1": {"number": 2, "selector": {"request-type": "v1"}}, "group2": {"number": 1}}}}`
+	if err := os.WriteFile(pb.allocatorConfigPath, []byte(changed), 0644); err != nil {
+		t.Fatalf("write config err: %v", err)
+	}
+	if rec = do("POST", "/v1/services/dash_svc/preview", edit, "admin", "secret"); rec.Code != http.StatusConflict {
+		t.Errorf("expect 409 for preview after config file changed, got %d", rec.Code)
+	}
+	fileVersion := configFileVersion(pb.allocatorConfigPath, "dash_svc")
+	if rec = do("POST", "/v1/services/dash_svc/apply", withVersion(fileVersion), "admin", "secret"); rec.Code != http.StatusConflict {
+		t.Errorf("expect 409 for apply after config file changed, got %d", rec.Code)
+	}
+	if data, _ := os.ReadFile(pb.allocatorConfigPath); string(data) != changed {
+		t.Errorf("config file should not be rewritten: %s", data)
+	}
+}
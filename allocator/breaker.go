@@ -0,0 +1,266 @@
+package allocator
+
+import (
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+	"time"
+)
+
+// breakerConfig 分组熔断配置，写在分组配置的 circuitBreaker 字段，例如：
+//
+//	"circuitBreaker": {
+//	  "consecutiveFailures": 10,
+//	  "failureRatio": 0.5,
+//	  "minRequests": 20,
+//	  "intervalSeconds": 10,
+//	  "openSeconds": 30,
+//	  "halfOpenRequests": 3,
+//	  "fallbackGroup": "group2"
+//	}
+//
+// 只有 UNAVAILABLE、DEADLINE_EXCEEDED、RESOURCE_EXHAUSTED 算作失败，业务错误不会触发熔断
+type breakerConfig struct {
+	// ConsecutiveFailures 连续失败多少次后熔断，0 表示不按连续失败熔断
+	ConsecutiveFailures int `json:"consecutiveFailures"`
+	// FailureRatio 统计周期内失败率达到该值时熔断，0 表示不按失败率熔断
+	FailureRatio float64 `json:"failureRatio"`
+	// MinRequests 统计周期内请求数不少于该值时才按失败率判断
+	MinRequests int `json:"minRequests"`
+	// IntervalSeconds 失败率统计周期，默认 10 秒
+	IntervalSeconds float64 `json:"intervalSeconds"`
+	// OpenSeconds 熔断后多久进入半开状态，默认 30 秒
+	OpenSeconds float64 `json:"openSeconds"`
+	// HalfOpenRequests 半开状态放行的探测请求数，全部成功后恢复，默认 1
+	HalfOpenRequests int `json:"halfOpenRequests"`
+	// FallbackGroup 熔断时转发到的分组，为空时直接返回错误
+	FallbackGroup string `json:"fallbackGroup,omitempty"`
+}
+
+func (c breakerConfig) withDefaults() breakerConfig {
+	if c.IntervalSeconds <= 0 {
+		c.IntervalSeconds = 10
+	}
+	if c.OpenSeconds <= 0 {
+		c.OpenSeconds = 30
+	}
+	if c.HalfOpenRequests <= 0 {
+		c.HalfOpenRequests = 1
+	}
+	return c
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// breakerStatus 熔断器状态，用于 http 查看
+type breakerStatus struct {
+	State               string        `json:"state"`
+	Requests            int           `json:"requests"`
+	Failures            int           `json:"failures"`
+	ConsecutiveFailures int           `json:"consecutiveFailures"`
+	OpenedAt            time.Time     `json:"openedAt"`
+	Config              breakerConfig `json:"config"`
+}
+
+// circuitBreaker 一个分组的熔断器：closed 正常放行，open 拒绝，open 一段时间后 half-open 放行少量探测请求
+type circuitBreaker struct {
+	mu          sync.Mutex
+	group       string
+	config      breakerConfig
+	state       breakerState
+	requests    int
+	failures    int
+	consecutive int
+	windowStart time.Time
+	openedAt    time.Time
+	// probes 半开状态已放行的探测请求数，probeSuccesses 其中成功的数量
+	probes         int
+	probeSuccesses int
+}
+
+// breakers 各服务分组的熔断器
+var breakers groupRegistry[*circuitBreaker]
+
+// breakerNow 熔断器使用的时钟，测试中替换以控制熔断时间
+var breakerNow = time.Now
+
+// getBreakers 按最新配置返回服务各分组的熔断器，配置中去掉熔断的分组同时删除其状态
+func getBreakers(serviceName string, sc *serviceConfig) map[string]*circuitBreaker {
+	return breakers.get(serviceName, sc,
+		func(info groupInfo) bool { return info.CircuitBreaker != nil },
+		func(groupName string) *circuitBreaker {
+			return &circuitBreaker{group: groupName, windowStart: breakerNow()}
+		},
+		func(b *circuitBreaker, info groupInfo) {
+			b.mu.Lock()
+			b.config = info.CircuitBreaker.withDefaults()
+			b.mu.Unlock()
+		})
+}
+
+// ready 熔断器是否放行请求，open 时间到了进入 half-open
+func (b *circuitBreaker) ready(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen && now.Sub(b.openedAt) >= time.Duration(b.config.OpenSeconds*float64(time.Second)) {
+		b.state = breakerHalfOpen
+		b.probes = 0
+		b.probeSuccesses = 0
+		log.Info().Msgf("circuit breaker of group %s half-open", b.group)
+	}
+	switch b.state {
+	case breakerOpen:
+		return false
+	case breakerHalfOpen:
+		return b.probes < b.config.HalfOpenRequests
+	}
+	return true
+}
+
+// onPick 请求被分配到该分组，半开状态下计入探测请求
+func (b *circuitBreaker) onPick() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		b.probes++
+	}
+}
+
+// isBreakerFailure 是否是下游过载或不可用导致的错误
+func isBreakerFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+// record 记录一次调用结果，更新熔断器状态
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := breakerNow()
+	failure := isBreakerFailure(err)
+	switch b.state {
+	case breakerClosed:
+		if now.Sub(b.windowStart) >= time.Duration(b.config.IntervalSeconds*float64(time.Second)) {
+			b.windowStart = now
+			b.requests = 0
+			b.failures = 0
+		}
+		b.requests++
+		if !failure {
+			b.consecutive = 0
+			return
+		}
+		b.failures++
+		b.consecutive++
+		if (b.config.ConsecutiveFailures > 0 && b.consecutive >= b.config.ConsecutiveFailures) ||
+			(b.config.FailureRatio > 0 && b.requests >= b.config.MinRequests &&
+				float64(b.failures)/float64(b.requests) >= b.config.FailureRatio) {
+			b.open(now)
+		}
+	case breakerHalfOpen:
+		if failure {
+			b.open(now)
+			return
+		}
+		b.probeSuccesses++
+		if b.probeSuccesses >= b.config.HalfOpenRequests {
+			b.state = breakerClosed
+			b.windowStart = now
+			b.requests = 0
+			b.failures = 0
+			b.consecutive = 0
+			log.Info().Msgf("circuit breaker of group %s closed", b.group)
+		}
+	}
+	// open 状态下收到的是熔断前发出的请求的结果，不影响状态
+}
+
+func (b *circuitBreaker) open(now time.Time) {
+	log.Info().Msgf("circuit breaker of group %s open, requests: %d, failures: %d, consecutive failures: %d",
+		b.group, b.requests, b.failures, b.consecutive)
+	b.state = breakerOpen
+	b.openedAt = now
+	b.requests = 0
+	b.failures = 0
+	b.consecutive = 0
+}
+
+func (b *circuitBreaker) fallbackGroup() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.config.FallbackGroup
+}
+
+func (b *circuitBreaker) status() breakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return breakerStatus{
+		State:               b.state.String(),
+		Requests:            b.requests,
+		Failures:            b.failures,
+		ConsecutiveFailures: b.consecutive,
+		OpenedAt:            b.openedAt,
+		Config:              b.config,
+	}
+}
+
+// breakerFilter 去掉熔断分组的连接；全部熔断时转发到配置的备用分组，没有备用分组时返回 UNAVAILABLE
+func (p *allocatorPicker) breakerFilter(candidates []connInfo) ([]connInfo, error) {
+	if len(p.breakers) == 0 {
+		return candidates, nil
+	}
+	now := breakerNow()
+	var remain []connInfo
+	var openGroup string
+	for _, ci := range candidates {
+		if b, ok := p.breakers[ci.group]; ok && !b.ready(now) {
+			openGroup = ci.group
+			continue
+		}
+		remain = append(remain, ci)
+	}
+	if len(remain) > 0 {
+		return remain, nil
+	}
+
+	fallback := p.breakers[openGroup].fallbackGroup()
+	if fallback != "" && fallback != openGroup {
+		if b, ok := p.breakers[fallback]; !ok || b.ready(now) {
+			if conns := p.getGroupConn(fallback); len(conns) > 0 {
+				log.Debug().Msgf("circuit breaker of group %s open, fallback to group %s", openGroup, fallback)
+				return conns, nil
+			}
+		}
+	}
+	return nil, status.Errorf(codes.Unavailable, "allocator: circuit breaker of group %s of %s is open", openGroup, p.serviceName)
+}
+
+// breakerSnapshot 返回服务各分组的熔断状态，没有配置熔断时返回 false
+func breakerSnapshot(serviceName string) (map[string]breakerStatus, bool) {
+	groups, ok := breakers.load(serviceName)
+	statuses := make(map[string]breakerStatus, len(groups))
+	for groupName, b := range groups {
+		statuses[groupName] = b.status()
+	}
+	return statuses, ok
+}
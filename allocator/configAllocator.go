@@ -29,11 +29,29 @@ const defaultGroupName string = "notGrouped"
 
 type serviceConfig struct {
 	Group map[string]groupInfo `json:"group"`
+	// OutlierDetection 不为空时开启异常副本检测
+	OutlierDetection *outlierConfig `json:"outlierDetection,omitempty"`
+	// Priority 调用的优先级及权重，分组排队时按权重公平调度
+	Priority *priorityConfig `json:"priority,omitempty"`
 }
 type groupInfo struct {
 	Number   int               `json:"number"`
 	Selector map[string]string `json:"selector"`
 	Weight   []float64         `json:"weight"`
+	// Labels 不为空时，只有副本标签全部匹配的连接才会分配到该分组
+	Labels map[string]string `json:"labels,omitempty"`
+	// CircuitBreaker 不为空时开启分组熔断
+	CircuitBreaker *breakerConfig `json:"circuitBreaker,omitempty"`
+	// Throttle 不为空时开启分组自适应限流
+	Throttle *throttleConfig `json:"throttle,omitempty"`
+	// MaxQPS、Burst 分组的令牌桶限速，MaxConcurrent 分组同时进行的请求数上限，0 表示不限制
+	MaxQPS        float64 `json:"maxQPS,omitempty"`
+	Burst         int     `json:"burst,omitempty"`
+	MaxConcurrent int     `json:"maxConcurrent,omitempty"`
+	// LimitMode 配额用完时的处理方式：fail 返回 RESOURCE_EXHAUSTED（默认），queue 排队等待配额
+	LimitMode string `json:"limitMode,omitempty"`
+	// MaxQueue queue 模式下排队的调用数上限，0 表示不限制
+	MaxQueue int `json:"maxQueue,omitempty"`
 }
 type groupAddresses struct {
 	Addresses []string           `json:"addresses"`
@@ -151,41 +169,47 @@ func addrAllocate(cis []connInfo, sc *serviceConfig) *groupsAddresses {
 	// 对键进行排序
 	sort.Strings(groupNames)
 
+	// 每次都重新分配，清空原有分组
+	for i := range cis {
+		cis[i].group = ""
+	}
+
 	// 解析 group
 	for _, groupName := range groupNames {
 		groupINfo := sc.Group[groupName]
 
-		// 一个 group 的地址放入 addr
+		// 一个 group 的地址放入 addr，按序选择未分组且标签匹配的连接
 		var addr []string
-		for i := 0; i < groupINfo.Number; i++ {
+		for i := 0; i < len(cis) && len(addr) < groupINfo.Number; i++ {
+			if cis[i].group != "" || !labelsMatch(cis[i].labels, groupINfo.Labels) {
+				continue
+			}
 			// 设置 connInfo 所属分组
-			cis[counter].group = groupName
-			addr = append(addr, cis[counter].addr)
-
+			cis[i].group = groupName
+			addr = append(addr, cis[i].addr)
 			counter++
-			// 配置分组的副本总和大于或等于可用连接数，后续分组不分配
-			if counter >= len(cis) {
-				groupsAddr[groupName] = groupAddresses{Addresses: addr}
-				return &groupsAddr
-			}
-
-			// 该分组分配完毕
-			if i == groupINfo.Number-1 {
-				groupsAddr[groupName] = groupAddresses{Addresses: addr}
-			}
+		}
+		if addr != nil {
+			groupsAddr[groupName] = groupAddresses{Addresses: addr}
+		}
+		// 配置分组的副本总和大于或等于可用连接数，后续分组不分配
+		if counter >= len(cis) {
+			return &groupsAddr
 		}
 	}
 
 	// 如果有多余的连接，这些连接没有所属的分组，默认为 notGrouped
 	var addr []string
-	for i := counter; i < len(cis); i++ {
-		// 设置 connInfo 所属分组
-		cis[counter].group = defaultGroupName
-		addr = append(addr, cis[counter].addr)
-		// 该分组分配完毕
-		if i == len(cis)-1 {
-			groupsAddr[defaultGroupName] = groupAddresses{Addresses: addr}
+	for i := range cis {
+		if cis[i].group != "" {
+			continue
 		}
+		// 设置 connInfo 所属分组
+		cis[i].group = defaultGroupName
+		addr = append(addr, cis[i].addr)
+	}
+	if addr != nil {
+		groupsAddr[defaultGroupName] = groupAddresses{Addresses: addr}
 	}
 
 	return &groupsAddr
@@ -223,7 +247,8 @@ func matchAddr(cis []connInfo, oldAddr *groupsAddresses, sc *serviceConfig) *gro
 		for _, address := range groupData.Addresses {
 			for i := 0; i < len(cis); i++ {
 				// 如果一个连接已分组，不再进行匹配，防止当地址重复时出现混乱
-				if cis[i].group != "" {
+				// 标签不再满足分组要求的连接也不保留
+				if cis[i].group != "" || !labelsMatch(cis[i].labels, sc.Group[groupName].Labels) {
 					continue
 				}
 				// 在未分组的连接中匹配到一个地址，该地址按原来的配置即可
@@ -258,8 +283,8 @@ func matchAddr(cis []connInfo, oldAddr *groupsAddresses, sc *serviceConfig) *gro
 		a := newAddr[groupName].Addresses
 		for j := 0; j < miss; j++ {
 			for i := 0; i < len(cis); i++ {
-				// 寻找还未分组的连接，加入到该分组中
-				if cis[i].group != "" {
+				// 寻找还未分组且标签匹配的连接，加入到该分组中
+				if cis[i].group != "" || !labelsMatch(cis[i].labels, sc.Group[groupName].Labels) {
 					continue
 				}
 				// 更新地址数据
@@ -0,0 +1,349 @@
+package allocator
+
+import (
+	"crypto/subtle"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// dashboardFiles dashboard 的静态页面，通过 /dashboard/ 访问，页面数据来自 /v1 管理接口
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+func dashboardHandler() http.Handler {
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/dashboard/", http.FileServer(http.FS(files)))
+}
+
+var (
+	authMu        sync.Mutex
+	adminUser     string
+	adminPassword string
+)
+
+// SetAdminCredentials 设置修改分组使用的 Basic Auth 用户名和密码，没有设置时 dashboard 只读
+func SetAdminCredentials(username string, password string) {
+	authMu.Lock()
+	defer authMu.Unlock()
+	adminUser = username
+	adminPassword = password
+}
+
+// authorized 校验 Basic Auth，失败时写入 401 或 403
+func authorized(w http.ResponseWriter, r *http.Request) bool {
+	authMu.Lock()
+	wantUser, wantPassword := adminUser, adminPassword
+	authMu.Unlock()
+	if wantPassword == "" {
+		http.Error(w, "editing is disabled, admin credentials are not set", http.StatusForbidden)
+		return false
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(wantUser)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(password), []byte(wantPassword)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="allocator"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// groupEdit 对一个分组的修改，为空的字段保持不变
+type groupEdit struct {
+	Number *int      `json:"number,omitempty"`
+	Weight []float64 `json:"weight,omitempty"`
+}
+
+// groupsEdit preview、apply 的请求体，例如 {"groups": {"group1": {"number": 3, "weight": [0.2, 0.3, 0.5]}}}
+// apply 时需要带上 preview 返回的 configVersion，确认应用的修改与预览时一致
+type groupsEdit struct {
+	Groups        map[string]groupEdit `json:"groups"`
+	ConfigVersion string               `json:"configVersion,omitempty"`
+}
+
+// connMove 修改后分组或权重变化的连接
+type connMove struct {
+	Addr       string  `json:"addr"`
+	FromGroup  string  `json:"fromGroup"`
+	ToGroup    string  `json:"toGroup"`
+	FromWeight float64 `json:"fromWeight"`
+	ToWeight   float64 `json:"toWeight"`
+}
+
+// reassignPlan 修改分组后的配置和连接分配
+type reassignPlan struct {
+	config  *serviceConfig
+	cis     []connInfo
+	newAddr *groupsAddresses
+	moves   []connMove
+}
+
+// copyServiceConfig 复制分组配置，normalizeWeight 会修改配置中的权重切片
+func copyServiceConfig(sc *serviceConfig) *serviceConfig {
+	c := *sc
+	c.Group = make(map[string]groupInfo, len(sc.Group))
+	for name, info := range sc.Group {
+		info.Weight = append([]float64(nil), info.Weight...)
+		c.Group[name] = info
+	}
+	return &c
+}
+
+// planReassign 按修改后的配置重新分配连接，不修改 picker 和文件
+// 与连接变化时一样用 matchAddr 保留原有的分配，分组变小时保留前面的地址；修改了权重的分组按新的权重重新分配
+func (p *allocatorPicker) planReassign(edits map[string]groupEdit) (*reassignPlan, error) {
+	p.mu.Lock()
+	old := make([]connInfo, len(p.connInfos))
+	copy(old, p.connInfos)
+	config := p.config
+	p.mu.Unlock()
+	if config == nil {
+		return nil, fmt.Errorf("service %s has no allocator config", p.serviceName)
+	}
+
+	sc := copyServiceConfig(config)
+	for name, e := range edits {
+		info, ok := sc.Group[name]
+		if !ok {
+			return nil, fmt.Errorf("group %s not found in config", name)
+		}
+		if e.Number != nil {
+			if *e.Number < 0 {
+				return nil, fmt.Errorf("number of group %s must not be negative", name)
+			}
+			info.Number = *e.Number
+		}
+		if e.Weight != nil {
+			for _, w := range e.Weight {
+				if w <= 0 {
+					return nil, fmt.Errorf("weight of group %s must be positive", name)
+				}
+			}
+			info.Weight = append([]float64(nil), e.Weight...)
+		}
+		sc.Group[name] = info
+	}
+
+	// 当前的分配作为旧数据
+	oldAddr := make(groupsAddresses)
+	for _, ci := range old {
+		g := oldAddr[ci.group]
+		if g.WeightMap == nil {
+			g.WeightMap = make(map[string]float64)
+		}
+		g.Addresses = append(g.Addresses, ci.addr)
+		g.WeightMap[ci.addr] = ci.weight
+		oldAddr[ci.group] = g
+	}
+	for name, info := range sc.Group {
+		if g, ok := oldAddr[name]; ok && len(g.Addresses) > info.Number {
+			g.Addresses = g.Addresses[:info.Number]
+			oldAddr[name] = g
+		}
+	}
+
+	cis := make([]connInfo, len(old))
+	copy(cis, old)
+	for i := range cis {
+		cis[i].group = ""
+		cis[i].weight = -1
+	}
+	newAddr := matchAddr(cis, &oldAddr, sc)
+	for i := range cis {
+		if e, ok := edits[cis[i].group]; ok && e.Weight != nil {
+			cis[i].weight = -1
+		}
+	}
+	appendWeightForNewConn(cis, newAddr, copyServiceConfig(sc))
+
+	plan := &reassignPlan{config: sc, cis: cis, newAddr: newAddr}
+	for i := range cis {
+		if cis[i].group != old[i].group || cis[i].weight != old[i].weight {
+			plan.moves = append(plan.moves, connMove{Addr: cis[i].addr, FromGroup: old[i].group, ToGroup: cis[i].group,
+				FromWeight: old[i].weight, ToWeight: cis[i].weight})
+		}
+	}
+	return plan, nil
+}
+
+// groups 返回修改后各分组的地址和权重
+func (plan *reassignPlan) groups() []adminGroup {
+	byName := make(map[string]*adminGroup)
+	for name, info := range plan.config.Group {
+		byName[name] = &adminGroup{Name: name, Number: info.Number, Selector: info.Selector, Labels: info.Labels,
+			Weight: info.Weight, Addrs: []string{}}
+	}
+	for _, ci := range plan.cis {
+		g, ok := byName[ci.group]
+		if !ok {
+			g = &adminGroup{Name: ci.group, Addrs: []string{}}
+			byName[ci.group] = g
+		}
+		g.Addrs = append(g.Addrs, ci.addr)
+	}
+	groups := make([]adminGroup, 0, len(byName))
+	for _, g := range byName {
+		groups = append(groups, *g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return groups
+}
+
+// applyReassign 在 picker 上使用新的分配，保留连接的 load
+func (p *allocatorPicker) applyReassign(plan *reassignPlan) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.connInfos {
+		p.connInfos[i].group = plan.cis[i].group
+		p.connInfos[i].weight = plan.cis[i].weight
+	}
+	p.config = plan.config
+}
+
+// editConfig 返回修改后的 allocator 配置文件内容，只修改分组的 number、weight，其他内容保持不变
+func editConfig(configPath string, serviceName string, edits map[string]groupEdit) ([]byte, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	var config map[string]map[string]interface{}
+	if err = json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	groups, ok := config[serviceName]["group"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("service %s has no group config in %s", serviceName, configPath)
+	}
+	for name, e := range edits {
+		group, ok := groups[name].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("group %s not found in %s", name, configPath)
+		}
+		if e.Number != nil {
+			group["number"] = *e.Number
+		}
+		if e.Weight != nil {
+			group["weight"] = e.Weight
+		}
+	}
+	return json.MarshalIndent(config, "", "  ")
+}
+
+// writeFileAtomic 先写入临时文件再重命名，picker 重建时不会读到不完整的文件
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// reassignMu 同一时间只执行一个修改
+var reassignMu sync.Mutex
+
+// editGroups POST /v1/services/{name}/preview 返回修改后的分配，apply 为 true 时写入配置文件和分组文件并立即生效
+// apply 必须带上 preview 返回的 configVersion，picker 重建或配置变化后返回 409，需要重新预览
+func editGroups(w http.ResponseWriter, r *http.Request, s *pickerState, apply bool) {
+	if !authorized(w, r) {
+		return
+	}
+	var edit groupsEdit
+	if err := json.NewDecoder(r.Body).Decode(&edit); err != nil {
+		http.Error(w, "Error decoding JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(edit.Groups) == 0 {
+		http.Error(w, "no group to edit", http.StatusBadRequest)
+		return
+	}
+
+	if apply && edit.ConfigVersion == "" {
+		http.Error(w, "configVersion from preview is required", http.StatusBadRequest)
+		return
+	}
+
+	// 加锁后重新读取服务状态，picker 或配置在 preview 之后变化时拒绝应用，需要重新预览
+	reassignMu.Lock()
+	defer reassignMu.Unlock()
+	current := getPickerState(s.picker.serviceName)
+	if current == nil || current.picker != s.picker {
+		http.Error(w, "picker of "+s.picker.serviceName+" was rebuilt, preview again", http.StatusConflict)
+		return
+	}
+	version := configFileVersion(current.configPath, current.picker.serviceName)
+	// 计划基于 picker 内存中的配置，文件在 picker 创建之后被修改时两者不一致，写入后文件和 picker 会不同
+	if version != current.configVersion {
+		http.Error(w, "config file of "+current.picker.serviceName+" changed since the picker was built, wait for it to reload", http.StatusConflict)
+		return
+	}
+	if apply && edit.ConfigVersion != version {
+		http.Error(w, "config of "+current.picker.serviceName+" changed since preview, preview again", http.StatusConflict)
+		return
+	}
+	p := current.picker
+	plan, err := p.planReassign(edit.Groups)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, err := editConfig(current.configPath, p.serviceName, edit.Groups)
+	if err != nil {
+		http.Error(w, "Error editing config: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	newVersion := configVersion(data, p.serviceName)
+	resp := map[string]interface{}{
+		"apiVersion":       adminAPIVersion,
+		"service":          p.serviceName,
+		"configVersion":    version,
+		"newConfigVersion": newVersion,
+		"groups":           plan.groups(),
+		"moves":            plan.moves,
+		"applied":          false,
+	}
+	if !apply {
+		writeJSON(w, resp)
+		return
+	}
+
+	if err = writeFileAtomic(current.configPath, data); err != nil {
+		http.Error(w, "Error writing config: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err = writeGroupAddr(p.serviceName+".json", plan.newAddr); err != nil {
+		http.Error(w, "Error writing group addresses: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.applyReassign(plan)
+	pickerMu.Lock()
+	if st, ok := pickers[p.serviceName]; ok && st.picker == p {
+		st.configVersion = newVersion
+	}
+	pickerMu.Unlock()
+	recordGroupConns(p.serviceName, plan.cis)
+	log.Info().Msgf("allocator dashboard: %s groups edited by %s, moves: %+v", p.serviceName, r.RemoteAddr, plan.moves)
+	resp["applied"] = true
+	writeJSON(w, resp)
+}
@@ -2,20 +2,76 @@ package allocator
 
 import (
 	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog/log"
 	"net/http"
 	"os"
 	"strconv"
+	"sync"
 )
 
 // GET /svc-info?name=exam_svc
-// GET /counter?key=request-type
-func httpServerStart(port int) {
-	http.HandleFunc("/svc-info", getSvcConfig)
-	//http.HandleFunc("/counter", getCounterInfo)
+// GET /counter?name=exam_svc
+// GET /outlier?name=exam_svc
+// GET /breaker?name=exam_svc
+// GET /request-counters
+// GET /aggregate?name=exam_svc
+// GET /metrics
+// GET /v1/services
+// GET /v1/services/{name}/groups
+// GET /v1/services/{name}/conns
+// POST /v1/services/{name}/preview
+// POST /v1/services/{name}/apply
+// GET /dashboard/
+func registerHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/svc-info", getSvcConfig)
+	mux.HandleFunc("/counter", getCounterInfo)
+	mux.HandleFunc("/outlier", getOutlierInfo)
+	mux.HandleFunc("/breaker", getBreakerInfo)
+	mux.HandleFunc("/request-counters", getRequestCounters)
+	// 汇总所有副本，需要先调用 EnablePeerAggregation
+	mux.HandleFunc("/aggregate", getAggregateInfo)
+	// Prometheus 指标，包括 allocator、consul resolver 等注册到默认 registry 的指标
+	mux.Handle("/metrics", promhttp.Handler())
+	// 版本化的管理接口，返回内存中 picker 的状态
+	mux.HandleFunc("/v1/services", listServices)
+	mux.HandleFunc("/v1/services/", serviceResource)
+	// dashboard 页面，修改分组需要 SetAdminCredentials
+	mux.Handle("/dashboard/", dashboardHandler())
+}
+
+// Handler 返回包含 allocator 所有接口的 http.Handler，每次调用返回新的 mux
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	return mux
+}
 
+var (
+	muxMu sync.Mutex
+	// userMux 不为 nil 时，接口已经注册到调用方的 mux 上
+	userMux *http.ServeMux
+)
+
+// UseServeMux 把 allocator 的接口注册到调用方的 mux 上，由调用方提供 http 服务，allocator 不再监听 allocatorPort
+// 需要在第一次 Dial 之前调用
+func UseServeMux(mux *http.ServeMux) {
+	muxMu.Lock()
+	defer muxMu.Unlock()
+	registerHandlers(mux)
+	userMux = mux
+}
+
+func externalMux() bool {
+	muxMu.Lock()
+	defer muxMu.Unlock()
+	return userMux != nil
+}
+
+// httpServerStart 在 port 上启动 allocator 的 http 服务，使用独立的 mux，不注册到 http.DefaultServeMux
+func httpServerStart(port int) {
 	log.Info().Msgf("Server is running on: %d", port)
-	err := http.ListenAndServe(":"+strconv.Itoa(port), nil)
+	err := http.ListenAndServe(":"+strconv.Itoa(port), Handler())
 	if err != nil {
 		log.Error().Msgf("HTTP Listen error: %v", err)
 		return
@@ -89,51 +145,69 @@ func getSvcConfig(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-//func getCounterInfo(w http.ResponseWriter, r *http.Request) {
-//	if rcs == nil {
-//		//w.Header().Set("Content-Type", "text/html")
-//		//w.WriteHeader(http.StatusOK)
-//		//_, _ = w.Write([]byte("The counter is not enabled or there are still no requests."))
-//		//return
-//		rcs = monitor.NewRequestCounters()
-//	}
-//	// 获取查询参数 key
-//	key := r.URL.Query().Get("key")
-//
-//	// 如果 key 不为空，返回指定 key 的计数信息
-//	if key != "" {
-//		if counterData, err := rcs.GetCounter(key).ToJSON(); err == nil {
-//			jsonData, err := json.Marshal(counterData)
-//			if err != nil {
-//				http.Error(w, "Error formatting JSON", http.StatusInternalServerError)
-//				return
-//			}
-//			w.Header().Set("Content-Type", "application/json")
-//			w.WriteHeader(http.StatusOK)
-//			_, err = w.Write(jsonData)
-//			if err != nil {
-//				return
-//			}
-//		} else {
-//			http.Error(w, "Key of Counter, to json error", http.StatusInternalServerError)
-//		}
-//	} else {
-//		// 返回整个 counterMap
-//		if allCountersData, err := rcs.ToJSON(); err == nil {
-//			jsonData, err := json.Marshal(allCountersData)
-//			if err != nil {
-//				http.Error(w, "Error formatting JSON", http.StatusInternalServerError)
-//				return
-//			}
-//			w.Header().Set("Content-Type", "application/json")
-//			w.WriteHeader(http.StatusOK)
-//			_, err = w.Write(jsonData)
-//			if err != nil {
-//				return
-//			}
-//		} else {
-//			http.Error(w, "all Counters, to json error", http.StatusInternalServerError)
-//		}
-//
-//	}
-//}
+// getOutlierInfo 返回服务的异常检测配置和每个副本的状态
+func getOutlierInfo(w http.ResponseWriter, r *http.Request) {
+	svcName := r.URL.Query().Get("name")
+	if svcName == "" {
+		http.Error(w, "Missing name parameter", http.StatusBadRequest)
+		return
+	}
+	config, hosts, ok := outlierSnapshot(svcName)
+	if !ok {
+		http.Error(w, "outlier detection is not enabled for target service", http.StatusNotFound)
+		return
+	}
+	jsonData, err := json.MarshalIndent(map[string]interface{}{"config": config, "hosts": hosts}, "", "  ")
+	if err != nil {
+		http.Error(w, "Error formatting JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(jsonData)
+}
+
+// getBreakerInfo 返回服务各分组的熔断状态
+func getBreakerInfo(w http.ResponseWriter, r *http.Request) {
+	svcName := r.URL.Query().Get("name")
+	if svcName == "" {
+		http.Error(w, "Missing name parameter", http.StatusBadRequest)
+		return
+	}
+	statuses, ok := breakerSnapshot(svcName)
+	if !ok {
+		http.Error(w, "circuit breaker is not enabled for target service", http.StatusNotFound)
+		return
+	}
+	jsonData, err := json.MarshalIndent(statuses, "", "  ")
+	if err != nil {
+		http.Error(w, "Error formatting JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(jsonData)
+}
+
+// getCounterInfo 返回配置了配额的分组的请求数，waiting_requests 为排队的调用数，out_ready_requests 为已经发出、还没有完成的请求数
+// 格式为 {"waiting_requests": {"exam_svc": {"group1": 3}}, "out_ready_requests": {"exam_svc": {"group1": 10}}}，name 参数可以只查看一个服务
+func getCounterInfo(w http.ResponseWriter, r *http.Request) {
+	waiting := make(map[string]map[string]int)
+	outReady := make(map[string]map[string]int)
+	for serviceName, groups := range limiterSnapshot(r.URL.Query().Get("name")) {
+		waiting[serviceName] = make(map[string]int)
+		outReady[serviceName] = make(map[string]int)
+		for groupName, requests := range groups {
+			waiting[serviceName][groupName] = requests.Waiting
+			outReady[serviceName][groupName] = requests.Inflight
+		}
+	}
+	jsonData, err := json.Marshal(map[string]interface{}{"waiting_requests": waiting, "out_ready_requests": outReady})
+	if err != nil {
+		http.Error(w, "Error formatting JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(jsonData)
+}
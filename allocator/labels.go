@@ -0,0 +1,11 @@
+package allocator
+
+// labelsMatch 副本标签是否满足分组要求的全部标签，分组没有要求时总是满足
+func labelsMatch(labels map[string]string, required map[string]string) bool {
+	for k, v := range required {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,353 @@
+package allocator
+
+import (
+	"context"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math"
+	"sync"
+	"time"
+)
+
+// 分组配额用完时的处理方式
+const (
+	// limitModeFail 直接返回 RESOURCE_EXHAUSTED，默认方式
+	limitModeFail = "fail"
+	// limitModeQueue 在 Pick 中排队等待配额，与 grpc 处理 ErrNoSubConnAvailable 一样，直到有配额或调用的 context 结束
+	// 队列先进先出，maxQueue 大于 0 时限制队列长度，队列满时返回 RESOURCE_EXHAUSTED
+	limitModeQueue = "queue"
+)
+
+// groupLimiter 一个分组的令牌桶限速和并发限制，配置来自分组的 maxQPS、burst、maxConcurrent、limitMode、maxQueue
+type groupLimiter struct {
+	mu            sync.Mutex
+	group         string
+	maxQPS        float64
+	burst         float64
+	maxConcurrent int
+	mode          string
+	maxQueue      int
+
+	tokens   float64
+	last     time.Time
+	inflight int
+
+	// waiters queue 模式下按优先级分别排队的调用，同一优先级先进先出，只有队首的调用尝试获取配额
+	// 不同优先级之间按权重公平调度：每个优先级有一个虚拟时间 pass，放行一个调用后增加 1/权重，
+	// pass 最小的优先级的第一个调用是队首；优先级重新开始排队时 pass 至少为 vtime，不能积累空闲期间的份额
+	waiters map[string][]*waiter
+	waiting int
+	pass    map[string]float64
+	weights map[string]float64
+	vtime   float64
+}
+
+// waiter 一个排队的调用，轮到它尝试获取配额时收到通知
+type waiter struct {
+	ready chan struct{}
+	class string
+}
+
+// limiters 各服务分组的配额限制器
+var limiters groupRegistry[*groupLimiter]
+
+// getLimiters 按最新配置返回服务各分组的限制器，配置变化时保留令牌和并发数
+func getLimiters(serviceName string, sc *serviceConfig) map[string]*groupLimiter {
+	return limiters.get(serviceName, sc,
+		func(info groupInfo) bool { return info.MaxQPS > 0 || info.MaxConcurrent > 0 },
+		func(groupName string) *groupLimiter {
+			return &groupLimiter{group: groupName, last: time.Now(), waiters: make(map[string][]*waiter),
+				pass: make(map[string]float64), weights: make(map[string]float64)}
+		},
+		(*groupLimiter).update)
+}
+
+// update 更新配置，burst 默认为 maxQPS 向上取整，新建的令牌桶是满的
+func (l *groupLimiter) update(info groupInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	burst := float64(info.Burst)
+	if burst <= 0 {
+		burst = math.Max(1, math.Ceil(info.MaxQPS))
+	}
+	if l.maxQPS <= 0 || l.tokens > burst {
+		l.tokens = burst
+	}
+	l.maxQPS = info.MaxQPS
+	l.burst = burst
+	l.maxConcurrent = info.MaxConcurrent
+	l.maxQueue = info.MaxQueue
+	l.mode = info.LimitMode
+	if l.mode != limitModeQueue {
+		l.mode = limitModeFail
+	}
+}
+
+// tryAcquire 尝试获取配额，已经有调用在排队时不获取，保证先来的调用先获取配额
+func (l *groupLimiter) tryAcquire(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.waiting > 0 {
+		return false
+	}
+	ok, _ := l.acquireLocked(now)
+	return ok
+}
+
+// acquireLocked 获取配额，失败时返回需要等待令牌的时间，0 表示要等待其他请求完成，调用方需要持有锁
+func (l *groupLimiter) acquireLocked(now time.Time) (bool, time.Duration) {
+	if l.maxConcurrent > 0 && l.inflight >= l.maxConcurrent {
+		return false, 0
+	}
+	if l.maxQPS > 0 {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.maxQPS)
+		l.last = now
+		if l.tokens < 1 {
+			return false, time.Duration((1 - l.tokens) / l.maxQPS * float64(time.Second))
+		}
+		l.tokens--
+	}
+	l.inflight++
+	return true, 0
+}
+
+// release 请求完成，归还并发配额并通知队首的调用
+func (l *groupLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight--
+	l.notifyHeadLocked()
+}
+
+// headLocked 返回队首的调用：pass 最小的优先级中最早排队的调用，没有排队的调用时返回 nil，调用方需要持有锁
+func (l *groupLimiter) headLocked() *waiter {
+	var head *waiter
+	for class, queue := range l.waiters {
+		if len(queue) == 0 {
+			continue
+		}
+		if head == nil || l.pass[class] < l.pass[head.class] ||
+			(l.pass[class] == l.pass[head.class] && class < head.class) {
+			head = queue[0]
+		}
+	}
+	return head
+}
+
+// notifyHeadLocked 通知队首的调用尝试获取配额，调用方需要持有锁
+func (l *groupLimiter) notifyHeadLocked() {
+	if head := l.headLocked(); head != nil {
+		select {
+		case head.ready <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// enqueueLocked 调用进入其优先级的队列，调用方需要持有锁
+func (l *groupLimiter) enqueueLocked(w *waiter, weight float64) {
+	if len(l.waiters[w.class]) == 0 && l.pass[w.class] < l.vtime {
+		l.pass[w.class] = l.vtime
+	}
+	l.weights[w.class] = weight
+	l.waiters[w.class] = append(l.waiters[w.class], w)
+	l.waiting++
+}
+
+// dequeueHeadLocked 队首的调用获取到配额后离开队列，推进其优先级的 pass，调用方需要持有锁
+func (l *groupLimiter) dequeueHeadLocked(w *waiter) {
+	l.waiters[w.class] = l.waiters[w.class][1:]
+	l.waiting--
+	l.vtime = l.pass[w.class]
+	l.pass[w.class] += 1 / l.weights[w.class]
+	l.cleanupLocked(w.class)
+}
+
+// cleanupLocked 优先级的队列为空时删除它的状态；pass 领先于 vtime 时保留，避免刚被放行的优先级重新排队时获得优势
+// 调用方需要持有锁
+func (l *groupLimiter) cleanupLocked(class string) {
+	if len(l.waiters[class]) > 0 {
+		return
+	}
+	delete(l.waiters, class)
+	delete(l.weights, class)
+	if l.pass[class] <= l.vtime {
+		delete(l.pass, class)
+	}
+}
+
+// removeLocked 从队列中删除调用，删除的是队首时通知新的队首，调用方需要持有锁
+func (l *groupLimiter) removeLocked(w *waiter) {
+	wasHead := l.headLocked() == w
+	queue := l.waiters[w.class]
+	for i, other := range queue {
+		if other == w {
+			l.waiters[w.class] = append(queue[:i], queue[i+1:]...)
+			l.waiting--
+			break
+		}
+	}
+	l.cleanupLocked(w.class)
+	if wasHead {
+		l.notifyHeadLocked()
+	}
+}
+
+// waitInQueue 按优先级排队等待配额，获取到配额时返回 nil；队列已满返回 RESOURCE_EXHAUSTED，context 结束时离开队列
+func (l *groupLimiter) waitInQueue(ctx context.Context, class string, weight float64) error {
+	l.mu.Lock()
+	if l.maxQueue > 0 && l.waiting >= l.maxQueue {
+		l.mu.Unlock()
+		return status.Errorf(codes.ResourceExhausted, "allocator: waiting queue of group %s is full", l.group)
+	}
+	w := &waiter{ready: make(chan struct{}, 1), class: class}
+	l.enqueueLocked(w, weight)
+	l.mu.Unlock()
+
+	for {
+		// 队首的调用尝试获取配额，令牌不足时等待令牌补充
+		var d time.Duration
+		l.mu.Lock()
+		if l.headLocked() == w {
+			ok, wait := l.acquireLocked(time.Now())
+			if ok {
+				l.dequeueHeadLocked(w)
+				l.notifyHeadLocked()
+				l.mu.Unlock()
+				return nil
+			}
+			d = wait
+		}
+		l.mu.Unlock()
+
+		var timeC <-chan time.Time
+		var timer *time.Timer
+		if d > 0 {
+			timer = time.NewTimer(d)
+			timeC = timer.C
+		}
+		select {
+		case <-w.ready:
+		case <-timeC:
+		case <-ctx.Done():
+			l.mu.Lock()
+			l.removeLocked(w)
+			l.mu.Unlock()
+			return contextStatus(ctx)
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// stats 返回排队的调用数和进行中的请求数
+func (l *groupLimiter) stats() (int, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.waiting, l.inflight
+}
+
+func (l *groupLimiter) queueing() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.mode == limitModeQueue
+}
+
+// contextStatus 把 context 的错误转换为 grpc 状态
+func contextStatus(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+	}
+	return status.Error(codes.Canceled, ctx.Err().Error())
+}
+
+// pickWithLimit 选择 load 最小的连接并获取其分组的配额，selectFn 返回本次调用的候选连接
+// 分组配额用完时先尝试其他候选分组；都用完时按分组的 limitMode 以调用的优先级排队等待或返回 RESOURCE_EXHAUSTED
+// 等待期间释放 p.mu，返回时仍持有 p.mu。等待期间 picker 可能已被替换，load 和候选连接也可能变化，
+// 拿到配额后 picker 失效则返回 ErrNoSubConnAvailable 让 grpc 用新的 picker 重新选择，否则重新获取候选连接
+func (p *allocatorPicker) pickWithLimit(ctx context.Context, selectFn func() ([]connInfo, error), class string, weight float64) (int, *groupLimiter, error) {
+	candidates, err := selectFn()
+	if err != nil {
+		return 0, nil, err
+	}
+	for {
+		index := p.minLoadConn(candidates)
+		group := p.connInfos[index].group
+		l := p.limiters[group]
+		if l == nil {
+			p.addLoad(index)
+			return index, nil, nil
+		}
+		if l.tryAcquire(time.Now()) {
+			p.addLoad(index)
+			return index, l, nil
+		}
+
+		var others []connInfo
+		for _, ci := range candidates {
+			if ci.group != group {
+				others = append(others, ci)
+			}
+		}
+		if len(others) > 0 {
+			candidates = others
+			continue
+		}
+		if !l.queueing() {
+			return 0, nil, status.Errorf(codes.ResourceExhausted, "allocator: quota of group %s of %s exhausted", group, p.serviceName)
+		}
+
+		// 剩下的候选连接都属于该分组，获取到配额后在其中选择
+		p.mu.Unlock()
+		err := l.waitInQueue(ctx, class, weight)
+		p.mu.Lock()
+		if err != nil {
+			return 0, nil, err
+		}
+		if !p.builder.isCurrent(p) {
+			l.release()
+			return 0, nil, balancer.ErrNoSubConnAvailable
+		}
+		if candidates, err = selectFn(); err != nil {
+			l.release()
+			return 0, nil, err
+		}
+		var inGroup []connInfo
+		for _, ci := range candidates {
+			if ci.group == group {
+				inGroup = append(inGroup, ci)
+			}
+		}
+		if len(inGroup) > 0 {
+			index = p.minLoadConn(inGroup)
+			p.addLoad(index)
+			return index, l, nil
+		}
+		// 等待期间该分组的连接都不再可用，归还配额后在新的候选连接中重新选择
+		l.release()
+	}
+}
+
+// groupRequests 分组排队的调用数和进行中的请求数
+type groupRequests struct {
+	Waiting  int
+	Inflight int
+}
+
+// limiterSnapshot 返回各服务配置了配额的分组的请求数，name 不为空时只返回该服务
+func limiterSnapshot(name string) map[string]map[string]groupRequests {
+	snapshot := make(map[string]map[string]groupRequests)
+	for serviceName, groups := range limiters.all() {
+		if name != "" && serviceName != name {
+			continue
+		}
+		snapshot[serviceName] = make(map[string]groupRequests, len(groups))
+		for groupName, l := range groups {
+			waiting, inflight := l.stats()
+			snapshot[serviceName][groupName] = groupRequests{Waiting: waiting, Inflight: inflight}
+		}
+	}
+	return snapshot
+}
@@ -0,0 +1,74 @@
+package allocator
+
+import (
+	"github.com/Chen-Jin-yuan/grpc/monitor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"sync"
+	"time"
+)
+
+// allocator 的 Prometheus 指标，注册到默认的 registry，由 http 服务的 /metrics 输出
+var (
+	picksTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "allocator_picks_total",
+		Help: "Number of calls picked to each address, by service and group.",
+	}, []string{"service", "group", "addr"})
+
+	pickerRebuildsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "allocator_picker_rebuilds_total",
+		Help: "Number of picker rebuilds caused by SubConn state changes.",
+	}, []string{"service"})
+
+	readySubConns = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "allocator_ready_subconns",
+		Help: "Number of ready SubConns in each group.",
+	}, []string{"service", "group"})
+)
+
+// recordPickerBuild 记录一次 picker 重建和重建后各分组的连接数，已经没有连接的分组不再输出
+func recordPickerBuild(serviceName string, cis []connInfo) {
+	pickerRebuildsTotal.WithLabelValues(serviceName).Inc()
+	recordGroupConns(serviceName, cis)
+}
+
+// groupAddr picksTotal 中一个服务的分组和地址标签
+type groupAddr struct {
+	group string
+	addr  string
+}
+
+// pickSeriesMu 保护 pickSeries，pickSeries 记录各服务当前的连接，连接移除或换了分组后删除 picksTotal 中对应的序列
+var (
+	pickSeriesMu sync.Mutex
+	pickSeries   = make(map[string]map[groupAddr]bool)
+)
+
+// recordGroupConns 记录各分组的连接数，并删除已经不存在的连接的选择次数，分组修改后也需要更新
+func recordGroupConns(serviceName string, cis []connInfo) {
+	readySubConns.DeletePartialMatch(prometheus.Labels{"service": serviceName})
+	groups := make(map[string]int)
+	conns := make(map[groupAddr]bool)
+	for _, ci := range cis {
+		groups[ci.group]++
+		conns[groupAddr{ci.group, ci.addr}] = true
+	}
+	for group, n := range groups {
+		readySubConns.WithLabelValues(serviceName, group).Set(float64(n))
+	}
+
+	pickSeriesMu.Lock()
+	defer pickSeriesMu.Unlock()
+	for ga := range pickSeries[serviceName] {
+		if !conns[ga] {
+			picksTotal.DeleteLabelValues(serviceName, ga.group, ga.addr)
+		}
+	}
+	pickSeries[serviceName] = conns
+}
+
+// pickRateWindow 管理接口和 dashboard 显示的选择速率的统计时间
+const pickRateWindow = 10 * time.Second
+
+// pickRates 按服务、地址统计最近一分钟的选择次数
+var pickRates = monitor.NewWindowCounters(time.Minute, 60)
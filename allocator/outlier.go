@@ -0,0 +1,241 @@
+package allocator
+
+import (
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+	"time"
+)
+
+// outlierConfig 异常副本检测配置，写在服务配置的 outlierDetection 字段，例如：
+//
+//	"outlierDetection": {
+//	  "consecutiveErrors": 5,
+//	  "successRateThreshold": 0.8,
+//	  "successRateMinRequests": 20,
+//	  "intervalSeconds": 10,
+//	  "baseEjectionSeconds": 30,
+//	  "maxEjectionSeconds": 300,
+//	  "maxEjectionPercent": 50
+//	}
+//
+// 只有 UNAVAILABLE 和 DEADLINE_EXCEEDED 算作副本异常，业务错误不影响副本状态
+type outlierConfig struct {
+	// ConsecutiveErrors 连续失败多少次后摘除，0 表示不按连续失败摘除
+	ConsecutiveErrors int `json:"consecutiveErrors"`
+	// SuccessRateThreshold 统计周期内成功率低于该值时摘除，0 表示不按成功率摘除
+	SuccessRateThreshold float64 `json:"successRateThreshold"`
+	// SuccessRateMinRequests 统计周期内请求数不少于该值时才按成功率判断
+	SuccessRateMinRequests int `json:"successRateMinRequests"`
+	// IntervalSeconds 成功率统计周期，默认 10 秒
+	IntervalSeconds float64 `json:"intervalSeconds"`
+	// BaseEjectionSeconds 第一次摘除的时间，之后每次摘除时间翻倍，默认 30 秒
+	BaseEjectionSeconds float64 `json:"baseEjectionSeconds"`
+	// MaxEjectionSeconds 最长摘除时间，默认 300 秒
+	MaxEjectionSeconds float64 `json:"maxEjectionSeconds"`
+	// MaxEjectionPercent 每个分组最多摘除的副本百分比，默认 50，分组内至少保留一个副本
+	MaxEjectionPercent int `json:"maxEjectionPercent"`
+}
+
+// withDefaults 填充默认值
+func (c outlierConfig) withDefaults() outlierConfig {
+	if c.IntervalSeconds <= 0 {
+		c.IntervalSeconds = 10
+	}
+	if c.BaseEjectionSeconds <= 0 {
+		c.BaseEjectionSeconds = 30
+	}
+	if c.MaxEjectionSeconds <= 0 {
+		c.MaxEjectionSeconds = 300
+	}
+	if c.MaxEjectionSeconds < c.BaseEjectionSeconds {
+		c.MaxEjectionSeconds = c.BaseEjectionSeconds
+	}
+	if c.MaxEjectionPercent <= 0 {
+		c.MaxEjectionPercent = 50
+	}
+	return c
+}
+
+// outlierHost 一个副本的统计和摘除状态，导出字段用于 http 查看
+type outlierHost struct {
+	Group             string    `json:"group"`
+	ConsecutiveErrors int       `json:"consecutiveErrors"`
+	Requests          int       `json:"requests"`
+	Successes         int       `json:"successes"`
+	Ejected           bool      `json:"ejected"`
+	EjectedUntil      time.Time `json:"ejectedUntil"`
+	// EjectionCount 连续被摘除的次数，决定下一次摘除的时间，恢复正常一个周期后减一
+	EjectionCount int `json:"ejectionCount"`
+}
+
+// outlierDetector 一个服务的异常副本检测
+type outlierDetector struct {
+	mu          sync.Mutex
+	config      outlierConfig
+	hosts       map[string]*outlierHost
+	groupSize   map[string]int
+	windowStart time.Time
+}
+
+// outlierDetectors 各服务的异常检测
+var outlierDetectors serviceRegistry[*outlierDetector]
+
+// getOutlierDetector 返回服务的异常检测，并按最新的配置和连接更新；没有配置时关闭检测并返回 nil
+func getOutlierDetector(serviceName string, config *outlierConfig, cis []connInfo) *outlierDetector {
+	return outlierDetectors.update(serviceName, func(d *outlierDetector, ok bool) (*outlierDetector, bool) {
+		if config == nil {
+			return nil, false
+		}
+		if !ok {
+			d = &outlierDetector{hosts: make(map[string]*outlierHost), windowStart: time.Now()}
+		}
+		d.update(config.withDefaults(), cis)
+		return d, true
+	})
+}
+
+// update 更新配置和分组，已经不存在的连接删除其状态
+func (d *outlierDetector) update(config outlierConfig, cis []connInfo) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.config = config
+	d.groupSize = make(map[string]int)
+	hosts := make(map[string]*outlierHost, len(cis))
+	for _, ci := range cis {
+		h, ok := d.hosts[ci.addr]
+		if !ok {
+			h = &outlierHost{}
+		}
+		h.Group = ci.group
+		hosts[ci.addr] = h
+		d.groupSize[ci.group]++
+	}
+	d.hosts = hosts
+}
+
+// isOutlierError 是否是副本异常导致的错误
+func isOutlierError(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// record 记录一次调用结果
+func (d *outlierDetector) record(addr string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	d.evaluate(now)
+	h, ok := d.hosts[addr]
+	if !ok {
+		return
+	}
+	h.Requests++
+	if !isOutlierError(err) {
+		h.Successes++
+		h.ConsecutiveErrors = 0
+		return
+	}
+	h.ConsecutiveErrors++
+	if d.config.ConsecutiveErrors > 0 && h.ConsecutiveErrors >= d.config.ConsecutiveErrors {
+		d.eject(addr, h, now)
+	}
+}
+
+// filter 去掉候选连接中被摘除的副本，全部被摘除时保留原有候选连接
+func (d *outlierDetector) filter(candidates []connInfo) []connInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.evaluate(time.Now())
+	var remain []connInfo
+	for _, ci := range candidates {
+		if h, ok := d.hosts[ci.addr]; ok && h.Ejected {
+			continue
+		}
+		remain = append(remain, ci)
+	}
+	if len(remain) == 0 {
+		return candidates
+	}
+	return remain
+}
+
+// evaluate 恢复摘除时间已到的副本；统计周期结束时按成功率摘除副本并开始新的周期
+func (d *outlierDetector) evaluate(now time.Time) {
+	for addr, h := range d.hosts {
+		if h.Ejected && now.After(h.EjectedUntil) {
+			h.Ejected = false
+			log.Info().Msgf("outlier detection: %s of group %s returned", addr, h.Group)
+		}
+	}
+	if now.Sub(d.windowStart) < time.Duration(d.config.IntervalSeconds*float64(time.Second)) {
+		return
+	}
+	d.windowStart = now
+	for addr, h := range d.hosts {
+		if !h.Ejected && d.config.SuccessRateThreshold > 0 && h.Requests > 0 &&
+			h.Requests >= d.config.SuccessRateMinRequests &&
+			float64(h.Successes)/float64(h.Requests) < d.config.SuccessRateThreshold {
+			d.eject(addr, h, now)
+		} else if !h.Ejected && h.EjectionCount > 0 {
+			h.EjectionCount--
+		}
+		h.Requests = 0
+		h.Successes = 0
+	}
+}
+
+// eject 摘除副本，摘除时间按摘除次数指数增长；分组摘除的副本数达到上限时不摘除
+func (d *outlierDetector) eject(addr string, h *outlierHost, now time.Time) {
+	if h.Ejected {
+		return
+	}
+	ejected := 0
+	for _, other := range d.hosts {
+		if other.Group == h.Group && other.Ejected {
+			ejected++
+		}
+	}
+	size := d.groupSize[h.Group]
+	limit := size * d.config.MaxEjectionPercent / 100
+	if limit > size-1 {
+		limit = size - 1
+	}
+	if ejected >= limit {
+		log.Info().Msgf("outlier detection: %s of group %s not ejected, %d of %d already ejected", addr, h.Group, ejected, size)
+		return
+	}
+
+	h.EjectionCount++
+	duration := d.config.BaseEjectionSeconds
+	for i := 1; i < h.EjectionCount && duration < d.config.MaxEjectionSeconds; i++ {
+		duration *= 2
+	}
+	if duration > d.config.MaxEjectionSeconds {
+		duration = d.config.MaxEjectionSeconds
+	}
+	h.Ejected = true
+	h.EjectedUntil = now.Add(time.Duration(duration * float64(time.Second)))
+	h.ConsecutiveErrors = 0
+	log.Info().Msgf("outlier detection: %s of group %s ejected for %.0fs, ejection count %d", addr, h.Group, duration, h.EjectionCount)
+}
+
+// outlierSnapshot 返回服务的检测配置和副本状态，没有开启检测时返回 false
+func outlierSnapshot(serviceName string) (outlierConfig, map[string]outlierHost, bool) {
+	d, ok := outlierDetectors.load(serviceName)
+	if !ok {
+		return outlierConfig{}, nil, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.evaluate(time.Now())
+	hosts := make(map[string]outlierHost, len(d.hosts))
+	for addr, h := range d.hosts {
+		hosts[addr] = *h
+	}
+	return d.config, hosts, true
+}
@@ -0,0 +1,57 @@
+package allocator
+
+import "strings"
+
+// defaultPriorityKey 没有配置 key 时，从 metadata 的 priority 字段读取优先级
+const defaultPriorityKey = "priority"
+
+// priorityConfig 服务的优先级配置，写在服务配置的 priority 字段，例如：
+//
+//	"priority": {
+//	  "key": "priority",
+//	  "classes": {"interactive": 8, "batch": 1},
+//	  "default": "interactive",
+//	  "methods": {"/pkg.Svc/Export": "batch"}
+//	}
+//
+// 分组使用 queue 模式排队时，不同优先级的调用按权重公平地获取配额：上面的配置下 interactive 与 batch 按 8:1 放行，
+// batch 调用再多也不会让 interactive 调用一直等待，同时 batch 调用也不会被饿死
+type priorityConfig struct {
+	// Key metadata 中优先级的键，默认 priority
+	Key string `json:"key"`
+	// Classes 优先级及其权重，权重不大于 0 时为 1
+	Classes map[string]float64 `json:"classes"`
+	// Default metadata 和方法都没有指定优先级，或指定的优先级不在 Classes 中时使用的优先级
+	Default string `json:"default"`
+	// Methods 按方法全名指定优先级，metadata 中的优先级优先
+	Methods map[string]string `json:"methods"`
+}
+
+// classify 返回调用的优先级和权重
+func (c *priorityConfig) classify(md map[string][]string, method string) (string, float64) {
+	if c == nil {
+		return "", 1
+	}
+	// grpc 的 metadata 键都是小写
+	key := strings.ToLower(c.Key)
+	if key == "" {
+		key = defaultPriorityKey
+	}
+	class := c.Default
+	if m, ok := c.Methods[method]; ok {
+		class = m
+	}
+	if values := md[key]; len(values) > 0 {
+		class = values[0]
+	}
+	// 优先级来自调用方的 metadata，只接受配置中的优先级，否则任意新的优先级都会排到队首，并且每个都占用队列的状态
+	weight, ok := c.Classes[class]
+	if !ok {
+		class = c.Default
+		weight = c.Classes[class]
+	}
+	if weight <= 0 {
+		weight = 1
+	}
+	return class, weight
+}
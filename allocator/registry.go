@@ -0,0 +1,75 @@
+package allocator
+
+import "sync"
+
+// serviceRegistry 按服务名保存的包级别状态（熔断、限流、配额、异常检测）。
+// picker 在连接变化时会重建，这些状态需要在重建之间保留，因此不放在 picker 里。
+// 保存的值只在 update 中替换，picker 和快照拿到后可以直接使用
+type serviceRegistry[T any] struct {
+	mu       sync.Mutex
+	services map[string]T
+}
+
+// update 在锁内用 fn 计算服务的新状态，fn 返回 false 时删除该服务的状态并返回零值
+func (r *serviceRegistry[T]) update(serviceName string, fn func(old T, ok bool) (T, bool)) T {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old, ok := r.services[serviceName]
+	v, keep := fn(old, ok)
+	if !keep {
+		delete(r.services, serviceName)
+		var zero T
+		return zero
+	}
+	if r.services == nil {
+		r.services = make(map[string]T)
+	}
+	r.services[serviceName] = v
+	return v
+}
+
+// load 返回服务的状态
+func (r *serviceRegistry[T]) load(serviceName string) (T, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v, ok := r.services[serviceName]
+	return v, ok
+}
+
+// all 返回所有服务的状态
+func (r *serviceRegistry[T]) all() map[string]T {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	services := make(map[string]T, len(r.services))
+	for serviceName, v := range r.services {
+		services[serviceName] = v
+	}
+	return services
+}
+
+// groupRegistry 按服务名、分组名保存的状态。
+// 每次 get 都新建分组的 map，保存后不再修改，picker 不需要自己复制
+type groupRegistry[T any] struct {
+	serviceRegistry[map[string]T]
+}
+
+// get 按最新配置返回服务各分组的状态：enabled 判断分组是否开启，新的分组用 newFn 创建，
+// 已有和新建的状态都用 updateFn 更新配置；配置中去掉的分组同时删除其状态，没有分组开启时返回 nil
+func (r *groupRegistry[T]) get(serviceName string, sc *serviceConfig, enabled func(info groupInfo) bool,
+	newFn func(groupName string) T, updateFn func(v T, info groupInfo)) map[string]T {
+	return r.update(serviceName, func(old map[string]T, _ bool) (map[string]T, bool) {
+		current := make(map[string]T)
+		for groupName, info := range sc.Group {
+			if !enabled(info) {
+				continue
+			}
+			v, ok := old[groupName]
+			if !ok {
+				v = newFn(groupName)
+			}
+			updateFn(v, info)
+			current[groupName] = v
+		}
+		return current, len(current) > 0
+	})
+}
@@ -0,0 +1,49 @@
+package allocator
+
+import (
+	"context"
+	"sync"
+)
+
+// pickReportKey 是 context 中 PickReport 的键
+type pickReportKey struct{}
+
+// PickReport 记录一次调用被 allocator 选中的服务、分组和地址，供拦截器写入追踪、监控等
+// 调用发生重试时，记录的是最后一次选择的结果
+type PickReport struct {
+	mu      sync.Mutex
+	service string
+	group   string
+	addr    string
+}
+
+// NewPickReportContext 返回带有 PickReport 的 context，使用该 context 发起调用后，可以从 PickReport 读取选择结果
+// ctx 中已经有 PickReport 时直接复用，多个拦截器可以读取到同一份结果
+func NewPickReportContext(ctx context.Context) (context.Context, *PickReport) {
+	if r := PickReportFromContext(ctx); r != nil {
+		return ctx, r
+	}
+	r := &PickReport{}
+	return context.WithValue(ctx, pickReportKey{}, r), r
+}
+
+// PickReportFromContext 返回 context 中的 PickReport，没有时返回 nil
+func PickReportFromContext(ctx context.Context) *PickReport {
+	r, _ := ctx.Value(pickReportKey{}).(*PickReport)
+	return r
+}
+
+// Get 返回选中的服务名、分组和地址，还没有选择时都为空
+func (r *PickReport) Get() (service string, group string, addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.service, r.group, r.addr
+}
+
+func (r *PickReport) set(service string, group string, addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.service = service
+	r.group = group
+	r.addr = addr
+}
@@ -0,0 +1,84 @@
+package allocator
+
+import (
+	"sync"
+	"time"
+)
+
+// CallIDKey 是 metadata 中调用 ID 的键，由 dialer 的拦截器在调用开始时设置
+// grpc 重试时使用同一个 context，所以同一次调用的多次尝试携带相同的调用 ID
+const CallIDKey = "x-allocator-call-id"
+
+// failedCallTTL 调用失败记录的保留时间，超过后清除，一次调用的重试通常远小于这个时间
+const failedCallTTL = time.Minute
+
+// failedCall 一次调用已经失败过的地址
+type failedCall struct {
+	addrs  map[string]struct{}
+	expire time.Time
+}
+
+// failedCalls 记录每次调用失败过的地址，重试时在同一分组中避开这些地址
+// picker 在连接变化时会重建，所以记录放在包级别，按调用 ID 区分，不同服务的调用 ID 不会重复
+type failedCalls struct {
+	mu        sync.Mutex
+	calls     map[string]*failedCall
+	lastSweep time.Time
+}
+
+var retryRecorder = &failedCalls{calls: make(map[string]*failedCall)}
+
+// record 记录调用在 addr 上失败，同时清理过期的记录
+func (f *failedCalls) record(callID string, addr string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	if now.Sub(f.lastSweep) > failedCallTTL {
+		f.lastSweep = now
+		for id, c := range f.calls {
+			if now.After(c.expire) {
+				delete(f.calls, id)
+			}
+		}
+	}
+
+	c, ok := f.calls[callID]
+	if !ok {
+		c = &failedCall{addrs: make(map[string]struct{})}
+		f.calls[callID] = c
+	}
+	c.addrs[addr] = struct{}{}
+	c.expire = now.Add(failedCallTTL)
+}
+
+// failed 返回调用失败过的地址，没有失败过时返回 nil
+func (f *failedCalls) failed(callID string) map[string]struct{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.calls[callID]
+	if !ok {
+		return nil
+	}
+	addrs := make(map[string]struct{}, len(c.addrs))
+	for addr := range c.addrs {
+		addrs[addr] = struct{}{}
+	}
+	return addrs
+}
+
+// excludeFailed 从候选连接中去掉调用已经失败过的地址，全部失败过时保留原有候选连接
+func excludeFailed(candidates []connInfo, failed map[string]struct{}) []connInfo {
+	if len(failed) == 0 {
+		return candidates
+	}
+	var remain []connInfo
+	for _, ci := range candidates {
+		if _, ok := failed[ci.addr]; !ok {
+			remain = append(remain, ci)
+		}
+	}
+	if len(remain) == 0 {
+		return candidates
+	}
+	return remain
+}
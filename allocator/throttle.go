@@ -0,0 +1,167 @@
+package allocator
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// throttleConfig 分组自适应限流配置，写在分组配置的 throttle 字段，例如：
+//
+//	"throttle": {"k": 2, "windowSeconds": 120, "buckets": 12}
+//
+// 参考 Google SRE 的客户端限流：统计窗口内的请求数 requests 和被后端接受的请求数 accepts，
+// 以 max(0, (requests - k*accepts) / (requests + 1)) 的概率在本地直接拒绝请求
+// 后端返回 RESOURCE_EXHAUSTED、UNAVAILABLE 视为拒绝，其他结果（包括业务错误）视为接受
+type throttleConfig struct {
+	// K 越小限流越激进，默认 2，即后端拒绝一半以上的请求时开始本地拒绝
+	K float64 `json:"k"`
+	// WindowSeconds 统计窗口，默认 120 秒
+	WindowSeconds float64 `json:"windowSeconds"`
+	// Buckets 滑动窗口分桶数，默认 12
+	Buckets int `json:"buckets"`
+}
+
+func (c throttleConfig) withDefaults() throttleConfig {
+	if c.K <= 0 {
+		c.K = 2
+	}
+	if c.WindowSeconds <= 0 {
+		c.WindowSeconds = 120
+	}
+	if c.Buckets <= 0 {
+		c.Buckets = 12
+	}
+	return c
+}
+
+// throttleBucket 滑动窗口中的一个桶
+type throttleBucket struct {
+	start    time.Time
+	requests int
+	accepts  int
+}
+
+// throttler 一个分组的自适应限流器
+type throttler struct {
+	mu      sync.Mutex
+	config  throttleConfig
+	buckets []throttleBucket
+}
+
+// throttlers 各服务分组的限流器
+var throttlers groupRegistry[*throttler]
+
+// getThrottlers 按最新配置返回服务各分组的限流器，配置改变窗口时重新统计
+func getThrottlers(serviceName string, sc *serviceConfig) map[string]*throttler {
+	return throttlers.get(serviceName, sc,
+		func(info groupInfo) bool { return info.Throttle != nil },
+		func(string) *throttler { return &throttler{} },
+		func(t *throttler, info groupInfo) {
+			config := info.Throttle.withDefaults()
+			t.mu.Lock()
+			if t.config != config {
+				t.config = config
+				t.buckets = make([]throttleBucket, config.Buckets)
+			}
+			t.mu.Unlock()
+		})
+}
+
+// bucket 返回当前时间所在的桶，桶已经过期时清空后复用
+func (t *throttler) bucket(now time.Time) *throttleBucket {
+	width := time.Duration(t.config.WindowSeconds * float64(time.Second) / float64(t.config.Buckets))
+	start := now.Truncate(width)
+	b := &t.buckets[int(start.UnixNano()/int64(width))%len(t.buckets)]
+	if !b.start.Equal(start) {
+		*b = throttleBucket{start: start}
+	}
+	return b
+}
+
+// counts 返回窗口内的请求数和接受数
+func (t *throttler) counts(now time.Time) (int, int) {
+	window := time.Duration(t.config.WindowSeconds * float64(time.Second))
+	requests, accepts := 0, 0
+	for _, b := range t.buckets {
+		if now.Sub(b.start) < window {
+			requests += b.requests
+			accepts += b.accepts
+		}
+	}
+	return requests, accepts
+}
+
+// rejectProbability 本地拒绝的概率
+func (t *throttler) rejectProbability(now time.Time) float64 {
+	requests, accepts := t.counts(now)
+	p := (float64(requests) - t.config.K*float64(accepts)) / float64(requests+1)
+	if p < 0 {
+		return 0
+	}
+	return p
+}
+
+// shouldReject 按拒绝概率决定是否在本地拒绝，不记录请求
+func (t *throttler) shouldReject() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return rand.Float64() < t.rejectProbability(time.Now())
+}
+
+// record 记录一次请求，accepted 表示后端接受了请求，本地拒绝的请求 accepted 为 false
+func (t *throttler) record(accepted bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.bucket(time.Now())
+	b.requests++
+	if accepted {
+		b.accepts++
+	}
+}
+
+// isBackendReject 后端是否因为过载拒绝了请求
+func isBackendReject(err error) bool {
+	switch status.Code(err) {
+	case codes.ResourceExhausted, codes.Unavailable:
+		return true
+	}
+	return false
+}
+
+// throttleFilter 每个分组按拒绝概率决定是否本地拒绝，去掉被拒绝分组的连接
+// 所有分组都拒绝时记录本地拒绝，返回 RESOURCE_EXHAUSTED
+func (p *allocatorPicker) throttleFilter(candidates []connInfo) ([]connInfo, error) {
+	if len(p.throttlers) == 0 {
+		return candidates, nil
+	}
+	rejected := make(map[string]bool)
+	var remain []connInfo
+	for _, ci := range candidates {
+		t, ok := p.throttlers[ci.group]
+		if !ok {
+			remain = append(remain, ci)
+			continue
+		}
+		reject, decided := rejected[ci.group]
+		if !decided {
+			reject = t.shouldReject()
+			rejected[ci.group] = reject
+		}
+		if !reject {
+			remain = append(remain, ci)
+		}
+	}
+	if len(remain) > 0 {
+		return remain, nil
+	}
+
+	var group string
+	for groupName := range rejected {
+		p.throttlers[groupName].record(false)
+		group = groupName
+	}
+	return nil, status.Errorf(codes.ResourceExhausted, "allocator: request to group %s of %s throttled locally", group, p.serviceName)
+}
@@ -0,0 +1,242 @@
+package composite
+
+import (
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Scheme composite resolver 的 scheme
+const Scheme = "composite"
+
+// Source 一个服务发现来源：子 resolver 的 builder 以及传给它的 target
+type Source struct {
+	// Name 来源名，会记录到地址的 Attributes 中，如 consul、static、file
+	Name    string
+	Builder resolver.Builder
+	// Target 子 resolver 的完整 target，如 consul://consul/svcName、static://svcName/host1:port
+	Target string
+}
+
+// sourcesKey 是 resolver.Address.Attributes 中来源列表的键
+type sourcesKey struct{}
+
+// Sources 返回地址来自哪些来源，按 Source 的配置顺序排列
+func Sources(addr resolver.Address) []string {
+	if addr.Attributes == nil {
+		return nil
+	}
+	sources, _ := addr.Attributes.Value(sourcesKey{}).([]string)
+	return sources
+}
+
+type compositeBuilder struct {
+	sources []Source
+}
+
+type compositeResolver struct {
+	mu       sync.Mutex
+	cc       resolver.ClientConn
+	svcName  string
+	children []resolver.Resolver
+	// addrs 每个来源最近一次推送的地址，下标与 sources 一致
+	addrs   [][]resolver.Address
+	sources []Source
+	closed  bool
+	// merged 上次合并的结果，以 Addr 为键
+	// balancer 以整个地址（包括 Attributes 指针）识别 SubConn，来源地址和来源列表不变时复用，避免重连
+	merged map[string]mergedAddr
+}
+
+// mergedAddr 合并前第一个来源的地址、全部来源以及合并后的地址
+type mergedAddr struct {
+	origin  resolver.Address
+	sources []string
+	addr    resolver.Address
+}
+
+// childClientConn 传给子 resolver 的 ClientConn，收到的地址交给 compositeResolver 合并
+type childClientConn struct {
+	parent *compositeResolver
+	index  int
+}
+
+// NewBuilder 返回 composite resolver 的 builder，sources 的顺序决定重复地址保留哪个来源的 Attributes
+func NewBuilder(sources ...Source) resolver.Builder {
+	return &compositeBuilder{sources: sources}
+}
+
+// Build 构建 resolver
+// 约定: target 形式为 composite:///svcName，svcName 不为空时统一写入所有地址的 ServerName
+func (cb *compositeBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	log.Info().Msgf("calling composite build, target: %v\n", target)
+	if len(cb.sources) == 0 {
+		return nil, fmt.Errorf("composite resolver: no source")
+	}
+
+	cr := &compositeResolver{
+		cc:      cc,
+		svcName: target.Endpoint,
+		addrs:   make([][]resolver.Address, len(cb.sources)),
+		sources: cb.sources,
+		merged:  make(map[string]mergedAddr),
+	}
+
+	for i, source := range cb.sources {
+		child, err := source.Builder.Build(parseTarget(source.Target), &childClientConn{parent: cr, index: i}, opts)
+		if err != nil {
+			cr.Close()
+			return nil, fmt.Errorf("composite resolver: build source %s error: %v", source.Name, err)
+		}
+		cr.mu.Lock()
+		cr.children = append(cr.children, child)
+		cr.mu.Unlock()
+	}
+	return cr, nil
+}
+
+func (cb *compositeBuilder) Scheme() string {
+	return Scheme
+}
+
+// update 记录一个来源的新地址，合并去重后推送
+func (cr *compositeResolver) update(index int, addrs []resolver.Address) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.closed {
+		return
+	}
+	cr.addrs[index] = addrs
+
+	merged := cr.merge()
+	log.Info().Msgf("composite newAddrs: %v\n", merged)
+	cr.cc.UpdateState(resolver.State{Addresses: merged})
+}
+
+// merge 合并所有来源的地址。重复的地址保留第一个来源的 Attributes（如 pod 标签），并记录全部来源
+// 第一个来源的地址和来源列表都没有变化时，复用上次合并的地址
+func (cr *compositeResolver) merge() []resolver.Address {
+	var origins []resolver.Address
+	index := make(map[string]int)
+	var sources [][]string
+
+	for i, addrs := range cr.addrs {
+		for _, a := range addrs {
+			if j, ok := index[a.Addr]; ok {
+				if n := len(sources[j]); sources[j][n-1] != cr.sources[i].Name {
+					sources[j] = append(sources[j], cr.sources[i].Name)
+				}
+				continue
+			}
+			index[a.Addr] = len(origins)
+			origins = append(origins, a)
+			sources = append(sources, []string{cr.sources[i].Name})
+		}
+	}
+
+	merged := make([]resolver.Address, 0, len(origins))
+	cache := make(map[string]mergedAddr, len(origins))
+	for i, origin := range origins {
+		m, ok := cr.merged[origin.Addr]
+		if !ok || m.origin != origin || !equalSources(m.sources, sources[i]) {
+			a := origin
+			if cr.svcName != "" {
+				a.ServerName = cr.svcName
+			}
+			if a.Attributes == nil {
+				a.Attributes = attributes.New(sourcesKey{}, sources[i])
+			} else {
+				a.Attributes = a.Attributes.WithValues(sourcesKey{}, sources[i])
+			}
+			m = mergedAddr{origin: origin, sources: sources[i], addr: a}
+		}
+		cache[origin.Addr] = m
+		merged = append(merged, m.addr)
+	}
+	cr.merged = cache
+
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].Addr < merged[j].Addr
+	})
+	return merged
+}
+
+func equalSources(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ResolveNow 转发给所有子 resolver
+func (cr *compositeResolver) ResolveNow(opt resolver.ResolveNowOptions) {
+	cr.mu.Lock()
+	children := cr.children
+	cr.mu.Unlock()
+	for _, child := range children {
+		child.ResolveNow(opt)
+	}
+}
+
+// Close 关闭所有子 resolver
+func (cr *compositeResolver) Close() {
+	cr.mu.Lock()
+	cr.closed = true
+	children := cr.children
+	cr.mu.Unlock()
+	for _, child := range children {
+		child.Close()
+	}
+}
+
+func (c *childClientConn) UpdateState(s resolver.State) {
+	c.parent.update(c.index, s.Addresses)
+}
+
+// ReportError 只要还有其他来源提供地址，就不向上报告错误
+func (c *childClientConn) ReportError(err error) {
+	log.Error().Msgf("composite source %s error: %v", c.parent.sources[c.index].Name, err)
+	c.parent.mu.Lock()
+	defer c.parent.mu.Unlock()
+	for i, addrs := range c.parent.addrs {
+		if i != c.index && len(addrs) > 0 {
+			return
+		}
+	}
+	c.parent.cc.ReportError(err)
+}
+
+func (c *childClientConn) NewAddress(addresses []resolver.Address) {
+	c.parent.update(c.index, addresses)
+}
+
+// NewServiceConfig 子 resolver 的 service config 不合并，忽略
+func (c *childClientConn) NewServiceConfig(serviceConfig string) {
+}
+
+func (c *childClientConn) ParseServiceConfig(serviceConfigJSON string) *serviceconfig.ParseResult {
+	return c.parent.cc.ParseServiceConfig(serviceConfigJSON)
+}
+
+// parseTarget 按 scheme://authority/endpoint 解析子 resolver 的 target，与 grpc 的解析方式一致
+func parseTarget(target string) resolver.Target {
+	scheme, rest := "", target
+	if i := strings.Index(target, "://"); i >= 0 {
+		scheme, rest = target[:i], target[i+3:]
+	}
+	authority, endpoint := "", rest
+	if i := strings.Index(rest, "/"); i >= 0 {
+		authority, endpoint = rest[:i], rest[i+1:]
+	}
+	return resolver.Target{Scheme: scheme, Authority: authority, Endpoint: endpoint}
+}
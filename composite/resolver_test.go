@@ -0,0 +1,120 @@
+package composite
+
+import (
+	"fmt"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+	"google.golang.org/grpc/serviceconfig"
+	"sync"
+	"testing"
+)
+
+type fakeClientConn struct {
+	mu    sync.Mutex
+	state resolver.State
+	err   error
+}
+
+func (cc *fakeClientConn) UpdateState(s resolver.State) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.state = s
+}
+func (cc *fakeClientConn) ReportError(err error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.err = err
+}
+func (cc *fakeClientConn) NewAddress(addresses []resolver.Address) {
+	cc.UpdateState(resolver.State{Addresses: addresses})
+}
+func (cc *fakeClientConn) NewServiceConfig(string) {
+}
+func (cc *fakeClientConn) ParseServiceConfig(string) *serviceconfig.ParseResult {
+	return nil
+}
+
+type labelKey struct{}
+
+func TestParseTarget(t *testing.T) {
+	cases := map[string]resolver.Target{
+		"consul://consul/exam_svc":         {Scheme: "consul", Authority: "consul", Endpoint: "exam_svc"},
+		"static:///1.0.0.1:1,1.0.0.2:1":    {Scheme: "static", Endpoint: "1.0.0.1:1,1.0.0.2:1"},
+		"file://exam_svc/etc/svc.json":     {Scheme: "file", Authority: "exam_svc", Endpoint: "etc/svc.json"},
+		"dns-srv://127.0.0.1:8600/a.b.c.d": {Scheme: "dns-srv", Authority: "127.0.0.1:8600", Endpoint: "a.b.c.d"},
+	}
+	for target, want := range cases {
+		if got := parseTarget(target); got != want {
+			t.Errorf("parseTarget(%s) = %+v, want %+v", target, got, want)
+		}
+	}
+}
+
+func TestCompositeResolver(t *testing.T) {
+	r1 := manual.NewBuilderWithScheme("src1")
+	r1.InitialState(resolver.State{Addresses: []resolver.Address{
+		{Addr: "1.0.0.1:1", Attributes: attributes.New(labelKey{}, "from-src1")},
+		{Addr: "1.0.0.2:1"},
+	}})
+	r2 := manual.NewBuilderWithScheme("src2")
+	r2.InitialState(resolver.State{Addresses: []resolver.Address{
+		{Addr: "1.0.0.2:1"},
+		{Addr: "1.0.0.3:1"},
+	}})
+
+	cc := &fakeClientConn{}
+	b := NewBuilder(Source{Name: "consul", Builder: r1, Target: "src1:///exam_svc"},
+		Source{Name: "static", Builder: r2, Target: "src2:///exam_svc"})
+	r, err := b.Build(resolver.Target{Scheme: Scheme, Endpoint: "exam_svc"}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("build err: %v", err)
+	}
+	defer r.Close()
+
+	addrs := cc.state.Addresses
+	fmt.Printf("composite addrs: %+v\n", addrs)
+	if len(addrs) != 3 {
+		t.Fatalf("expect 3 deduplicated addresses, got %d", len(addrs))
+	}
+	for _, a := range addrs {
+		if a.ServerName != "exam_svc" {
+			t.Errorf("expect ServerName exam_svc, got %s", a.ServerName)
+		}
+	}
+	if v := addrs[0].Attributes.Value(labelKey{}); v != "from-src1" {
+		t.Errorf("source attributes not preserved: %v", v)
+	}
+	if s := Sources(addrs[1]); len(s) != 2 || s[0] != "consul" || s[1] != "static" {
+		t.Errorf("expect 1.0.0.2:1 from both sources, got %v", s)
+	}
+
+	// 相同的地址再推送一次，合并结果不变（Attributes 指针也相同），balancer 不会重建 SubConn
+	r2.UpdateState(resolver.State{Addresses: []resolver.Address{{Addr: "1.0.0.2:1"}, {Addr: "1.0.0.3:1"}}})
+	again := cc.state.Addresses
+	fmt.Printf("composite addrs after identical update: %+v\n", again)
+	if len(again) != len(addrs) {
+		t.Fatalf("expect %d addresses after identical update, got %d", len(addrs), len(again))
+	}
+	for i := range addrs {
+		if again[i] != addrs[i] {
+			t.Errorf("address %s changed after identical update", addrs[i].Addr)
+		}
+	}
+
+	// 一个来源的地址变化只替换该来源的部分
+	r2.UpdateState(resolver.State{Addresses: []resolver.Address{{Addr: "1.0.0.4:1"}}})
+	before := addrs
+	addrs = cc.state.Addresses
+	fmt.Printf("composite addrs after update: %+v\n", addrs)
+	if len(addrs) != 3 || addrs[2].Addr != "1.0.0.4:1" {
+		t.Fatalf("unexpected addrs after update: %+v", addrs)
+	}
+	// 1.0.0.1:1 的来源没有变化，地址保持不变；1.0.0.2:1 只剩一个来源，需要重新生成
+	if addrs[0] != before[0] {
+		t.Errorf("unchanged address 1.0.0.1:1 should be reused")
+	}
+	if s := Sources(addrs[1]); len(s) != 1 || s[0] != "consul" {
+		t.Errorf("expect 1.0.0.2:1 only from consul, got %v", s)
+	}
+}
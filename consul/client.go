@@ -2,6 +2,8 @@ package consul
 
 import (
 	consul "github.com/hashicorp/consul/api"
+	"net"
+	"strconv"
 )
 
 // NewClient returns a new Client with connection to consul
@@ -21,3 +23,24 @@ func NewClient(addr string) (*Client, error) {
 type Client struct {
 	*consul.Client
 }
+
+// PeerLister 返回一个函数，列出服务 svcName 所有健康副本的 host:port，port 为各副本相同的端口，
+// 例如传给 allocator.EnablePeerAggregation 汇总各副本 allocator http 服务的状态
+func (c *Client) PeerLister(svcName string, port int) func() ([]string, error) {
+	return func() ([]string, error) {
+		services, _, err := c.Health().Service(svcName, "", true, nil)
+		if err != nil {
+			return nil, err
+		}
+		var peers []string
+		for _, service := range services {
+			host := service.Service.Address
+			// 如果服务地址为空，使用节点地址作为替代
+			if len(host) == 0 {
+				host = service.Node.Address
+			}
+			peers = append(peers, net.JoinHostPort(host, strconv.Itoa(port)))
+		}
+		return peers, nil
+	}
+}
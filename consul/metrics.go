@@ -0,0 +1,26 @@
+package consul
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// consul resolver 的 Prometheus 指标，注册到默认的 registry
+var (
+	resolverUpdatesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "consul_resolver_updates_total",
+		Help: "Number of address updates pushed to gRPC by the consul resolver.",
+	}, []string{"service"})
+
+	resolverErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "consul_resolver_errors_total",
+		Help: "Number of failed consul health queries.",
+	}, []string{"service"})
+
+	// queryDuration 包括阻塞查询等待变化的时间，没有变化时接近 consul 的最长等待时间
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "consul_query_duration_seconds",
+		Help:    "Latency of consul health queries, including the blocking wait.",
+		Buckets: []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 30, 60, 300, 600},
+	}, []string{"service"})
+)
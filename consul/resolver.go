@@ -7,6 +7,7 @@ import (
 	"net"
 	"strconv"
 	"sync"
+	"time"
 )
 
 var (
@@ -62,15 +63,21 @@ func (cb *consulBuilder) Build(target resolver.Target, cc resolver.ClientConn, o
 
 func (cr *consulResolver) watcher() {
 	log.Info().Msg("calling consul watcher\n")
+	defer cr.wg.Done()
 	for {
 		select {
 		// 如果接收到退出信号（r.quitC），则跳出循环，终止更新过程。
+		// 注：select 中的 break 只会跳出 select，需要 return，否则 Close 会一直等待
 		case <-cr.quitC:
-			break
+			return
 		default:
+			start := time.Now()
 			newAddrs, lastIndex, err := cr.getInstances(cr.lastIndex)
+			queryDuration.WithLabelValues(cr.svcName).Observe(time.Since(start).Seconds())
 			if err != nil {
+				resolverErrorsTotal.WithLabelValues(cr.svcName).Inc()
 				log.Error().Msgf("error retrieving instances from Consul: %v\n", err)
+				continue
 			}
 
 			// 更新索引
@@ -78,6 +85,7 @@ func (cr *consulResolver) watcher() {
 			log.Info().Msgf("newAddrs: %v\n", newAddrs)
 			cr.cc.NewAddress(newAddrs)
 			cr.cc.NewServiceConfig(cr.svcName)
+			resolverUpdatesTotal.WithLabelValues(cr.svcName).Inc()
 		}
 	}
 
@@ -0,0 +1,115 @@
+package consul
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeClientConn struct {
+	mu      sync.Mutex
+	addrs   []resolver.Address
+	updated chan struct{}
+}
+
+func (cc *fakeClientConn) UpdateState(s resolver.State) {
+	cc.NewAddress(s.Addresses)
+}
+func (cc *fakeClientConn) ReportError(error) {
+}
+func (cc *fakeClientConn) NewAddress(addresses []resolver.Address) {
+	cc.mu.Lock()
+	cc.addrs = addresses
+	cc.mu.Unlock()
+	select {
+	case cc.updated <- struct{}{}:
+	default:
+	}
+}
+func (cc *fakeClientConn) NewServiceConfig(string) {
+}
+func (cc *fakeClientConn) ParseServiceConfig(string) *serviceconfig.ParseResult {
+	return nil
+}
+
+func TestWatcherMetrics(t *testing.T) {
+	svc := "metrics_svc"
+	// 模拟 consul：第一次查询失败，之后返回一个实例；索引未变化时阻塞，模拟 consul 的阻塞查询
+	var queries int32
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&queries, 1) == 1 {
+			http.Error(w, "consul unavailable", http.StatusInternalServerError)
+			return
+		}
+		if r.URL.Query().Get("index") == "7" {
+			<-done
+		}
+		w.Header().Set("X-Consul-Index", "7")
+		fmt.Fprint(w, `[{"Node":{"Address":"10.0.0.1"},"Service":{"Address":"10.0.0.1","Port":8080}}]`)
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = c
+
+	cc := &fakeClientConn{updated: make(chan struct{}, 1)}
+	r, err := NewBuilder().Build(resolver.Target{Endpoint: svc}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-cc.updated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no address update from consul resolver")
+	}
+	close(done)
+	r.Close()
+
+	cc.mu.Lock()
+	fmt.Printf("addrs: %v\n", cc.addrs)
+	if len(cc.addrs) != 1 || cc.addrs[0].Addr != "10.0.0.1:8080" {
+		t.Errorf("unexpected addrs: %v", cc.addrs)
+	}
+	cc.mu.Unlock()
+
+	// 失败的查询只计入错误数，不计入更新数；关闭时阻塞中的查询可能再返回一次
+	errs := testutil.ToFloat64(resolverErrorsTotal.WithLabelValues(svc))
+	updates := testutil.ToFloat64(resolverUpdatesTotal.WithLabelValues(svc))
+	fmt.Printf("errors: %v, updates: %v\n", errs, updates)
+	if errs != 1 {
+		t.Errorf("expect 1 error, got %v", errs)
+	}
+	if updates < 1 || updates > 2 {
+		t.Errorf("expect updates only for successful queries, got %v", updates)
+	}
+}
+
+func TestPeerLister(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"Node":{"Address":"10.0.0.1"},"Service":{"Address":"","Port":8080}},
+			{"Node":{"Address":"10.0.0.9"},"Service":{"Address":"10.0.0.2","Port":8080}}]`)
+	}))
+	defer srv.Close()
+	c, err := NewClient(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 服务地址为空时使用节点地址，端口使用传入的 http 端口
+	peers, err := c.PeerLister("exam_svc", 10001)()
+	fmt.Printf("peers: %v\n", peers)
+	if err != nil || len(peers) != 2 || peers[0] != "10.0.0.1:10001" || peers[1] != "10.0.0.2:10001" {
+		t.Errorf("unexpected peers: %v, %v", peers, err)
+	}
+}
@@ -0,0 +1,37 @@
+package dialer
+
+import (
+	"context"
+	"fmt"
+	"github.com/Chen-Jin-yuan/grpc/allocator"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"sync/atomic"
+	"time"
+)
+
+// callIDPrefix 进程启动时间，与自增序号组成调用 ID，不同进程之间不会重复
+var callIDPrefix = fmt.Sprintf("%x", time.Now().UnixNano())
+
+var callSeq uint64
+
+// withCallID 在 metadata 中设置调用 ID，已经有调用 ID 时保持不变（如对冲的多次尝试）
+// grpc 重试时复用同一个 context，allocator 根据调用 ID 避开这次调用已经失败过的连接
+func withCallID(ctx context.Context) context.Context {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	if len(md.Get(allocator.CallIDKey)) > 0 {
+		return ctx
+	}
+	id := fmt.Sprintf("%s-%d", callIDPrefix, atomic.AddUint64(&callSeq, 1))
+	return metadata.AppendToOutgoingContext(ctx, allocator.CallIDKey, id)
+}
+
+func callIDUnaryInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(withCallID(ctx), method, req, reply, cc, opts...)
+}
+
+func callIDStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string,
+	streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(withCallID(ctx), desc, cc, method, opts...)
+}
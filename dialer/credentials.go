@@ -0,0 +1,177 @@
+package dialer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certCheckInterval 握手时检查证书文件是否变化的最小间隔
+const certCheckInterval = 10 * time.Second
+
+// WithInsecure 显式使用不安全连接
+func WithInsecure() DialOption {
+	return func(name string) (grpc.DialOption, error) {
+		return dialerOption{apply: func(cfg *dialConfig) {
+			cfg.insecure = true
+			cfg.tlsConfig = nil
+		}}, nil
+	}
+}
+
+// WithTLS 使用 TLS，系统根证书校验服务端证书
+// 注：consul 等 resolver 会把服务名写入地址的 ServerName，此时服务端证书需要包含服务名，否则使用 WithServerNameOverride
+func WithTLS() DialOption {
+	return func(name string) (grpc.DialOption, error) {
+		return withTLSConfig(&tls.Config{}), nil
+	}
+}
+
+// WithTLSFromCA 使用 TLS，caFile 中的 CA 证书校验服务端证书
+func WithTLSFromCA(caFile string) DialOption {
+	return func(name string) (grpc.DialOption, error) {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		return withTLSConfig(&tls.Config{RootCAs: pool}), nil
+	}
+}
+
+// WithMTLS 使用双向 TLS，caFile 为空时使用系统根证书
+// 客户端证书文件更新后（如证书轮换），新建立的连接会自动使用新证书，不需要重启
+func WithMTLS(caFile string, certFile string, keyFile string) DialOption {
+	return func(name string) (grpc.DialOption, error) {
+		cfg := &tls.Config{}
+		if caFile != "" {
+			pool, err := loadCertPool(caFile)
+			if err != nil {
+				return nil, err
+			}
+			cfg.RootCAs = pool
+		}
+		reloader, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = reloader.getClientCertificate
+		return withTLSConfig(cfg), nil
+	}
+}
+
+// WithServerNameOverride 按目标覆盖校验服务端证书时使用的名字
+// overrides 的键为 Dial 的 name 或其 endpoint 部分（consul 下即服务名），没有匹配时不覆盖
+func WithServerNameOverride(overrides map[string]string) DialOption {
+	return func(name string) (grpc.DialOption, error) {
+		serverName, ok := overrides[name]
+		if !ok {
+			serverName, ok = overrides[name[strings.LastIndex(name, "/")+1:]]
+		}
+		return dialerOption{apply: func(cfg *dialConfig) {
+			if ok {
+				cfg.serverName = serverName
+			}
+		}}, nil
+	}
+}
+
+func withTLSConfig(tlsConfig *tls.Config) dialerOption {
+	return dialerOption{apply: func(cfg *dialConfig) {
+		cfg.tlsConfig = tlsConfig
+		cfg.insecure = false
+	}}
+}
+
+// loadCertPool 读取 PEM 格式的 CA 证书
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read ca file %s error: %v", caFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no valid certificate in ca file %s", caFile)
+	}
+	return pool, nil
+}
+
+// certReloader 握手时检查证书文件的修改时间，变化后重新加载
+// 只在握手时检查，不需要后台 goroutine；已经建立的连接不受证书更新影响
+type certReloader struct {
+	mu        sync.Mutex
+	certFile  string
+	keyFile   string
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload 重新加载证书，调用方需要持有锁或保证没有并发
+func (r *certReloader) reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("load key pair %s, %s error: %v", r.certFile, r.keyFile, err)
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+// latestModTime 返回证书和私钥文件中较新的修改时间
+func (r *certReloader) latestModTime() (time.Time, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+	return certInfo.ModTime(), nil
+}
+
+// getClientCertificate 返回最新的证书，重新加载失败时继续使用原有证书
+func (r *certReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.lastCheck) < certCheckInterval {
+		return r.cert, nil
+	}
+	r.lastCheck = time.Now()
+
+	modTime, err := r.latestModTime()
+	if err != nil {
+		log.Error().Msgf("stat client certificate error: %v", err)
+		return r.cert, nil
+	}
+	if modTime.Equal(r.modTime) {
+		return r.cert, nil
+	}
+	if err = r.reload(); err != nil {
+		log.Error().Msgf("reload client certificate error: %v", err)
+		return r.cert, nil
+	}
+	log.Info().Msgf("client certificate %s reloaded", r.certFile)
+	return r.cert, nil
+}
@@ -1,6 +1,7 @@
 package dialer
 
 import (
+	"crypto/tls"
 	"fmt"
 	"github.com/Chen-Jin-yuan/grpc/allocator"
 	"google.golang.org/grpc/balancer/roundrobin"
@@ -8,21 +9,75 @@ import (
 	"strings"
 	"time"
 
+	"github.com/Chen-Jin-yuan/grpc/composite"
 	"github.com/Chen-Jin-yuan/grpc/consul"
+	"github.com/Chen-Jin-yuan/grpc/dnssrv"
+	"github.com/Chen-Jin-yuan/grpc/k8s"
+	"github.com/Chen-Jin-yuan/grpc/static"
 	"github.com/grpc-ecosystem/grpc-opentracing/go/otgrpc"
 
 	"github.com/opentracing/opentracing-go"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
+	"k8s.io/client-go/kubernetes"
 )
 
 // DialOption 允许配置拨号器的可选参数
 type DialOption func(name string) (grpc.DialOption, error)
 
-// WithTracer 启用追踪RPC调用
+// dialConfig Dial 收集的配置，部分选项需要与其他选项组合后才能生成 grpc.DialOption
+type dialConfig struct {
+	// tlsConfig 和 insecure 二选一，必须显式设置其中一个
+	tlsConfig  *tls.Config
+	insecure   bool
+	serverName string
+
+	// serviceName static:///host1:port 这类 target 中没有服务名时使用的服务名
+	serviceName string
+
+	// balancer 负载均衡的名字，policy 调用策略，两者组合成默认的 service config
+	balancer string
+	policy   *ServicePolicy
+
+	// unary、stream 所有选项的拦截器，按选项顺序组成拦截器链
+	unary  []grpc.UnaryClientInterceptor
+	stream []grpc.StreamClientInterceptor
+}
+
+// dialerOption 不直接修改 grpc 的拨号配置，由 Dial 收集到 dialConfig 后统一处理
+type dialerOption struct {
+	grpc.EmptyDialOption
+	apply func(cfg *dialConfig)
+}
+
+// WithTracer 启用追踪RPC调用，一元调用和流式调用都会被追踪，并记录 allocator 选择的分组和地址
 func WithTracer(tracer opentracing.Tracer) DialOption {
 	return func(name string) (grpc.DialOption, error) {
-		return grpc.WithUnaryInterceptor(otgrpc.OpenTracingClientInterceptor(tracer)), nil
+		return dialerOption{apply: func(cfg *dialConfig) {
+			// otgrpc 的拦截器在前，创建 span 后再由 pickTag 拦截器补充选择结果
+			cfg.unary = append(cfg.unary, otgrpc.OpenTracingClientInterceptor(tracer), pickTagUnaryInterceptor)
+			cfg.stream = append(cfg.stream, otgrpc.OpenTracingStreamClientInterceptor(tracer), pickTagStreamInterceptor)
+		}}, nil
+	}
+}
+
+// WithUnaryInterceptors 添加一元调用拦截器，与其他选项的拦截器按选项顺序组成拦截器链
+// 注：不要通过自定义 DialOption 返回 grpc.WithUnaryInterceptor，多次使用时只有最后一个生效
+func WithUnaryInterceptors(interceptors ...grpc.UnaryClientInterceptor) DialOption {
+	return func(name string) (grpc.DialOption, error) {
+		return dialerOption{apply: func(cfg *dialConfig) {
+			cfg.unary = append(cfg.unary, interceptors...)
+		}}, nil
+	}
+}
+
+// WithStreamInterceptors 添加流式调用拦截器，与其他选项的拦截器按选项顺序组成拦截器链
+func WithStreamInterceptors(interceptors ...grpc.StreamClientInterceptor) DialOption {
+	return func(name string) (grpc.DialOption, error) {
+		return dialerOption{apply: func(cfg *dialConfig) {
+			cfg.stream = append(cfg.stream, interceptors...)
+		}}, nil
 	}
 }
 
@@ -31,28 +86,95 @@ func WithBalancer(client *consul.Client, configPath string, allocatorPort int) D
 	return func(name string) (grpc.DialOption, error) {
 		// 借助 consul 的服务注册与服务发现机制，执行负载均衡
 		consul.InitResolver(client)
+		return WithAllocator(configPath, allocatorPort)(name)
+	}
+}
+
+// WithAllocator 只启用 allocator 负载均衡，不依赖 consul，配合 static、file 等 resolver 使用
+func WithAllocator(configPath string, allocatorPort int) DialOption {
+	return func(name string) (grpc.DialOption, error) {
 		// 如果文件不存在，使用轮询策略
 		_, err := os.Stat(configPath)
 		if os.IsNotExist(err) {
-			return grpc.WithBalancerName(roundrobin.Name), nil
+			return withBalancerName(roundrobin.Name), nil
 		}
-		// 使用 allocator
 		allocator.Init(configPath, allocatorPort)
-		return grpc.WithBalancerName(allocator.Name), nil
+		return withBalancerName(allocator.Name), nil
+	}
+}
+
+// WithServiceName 设置服务名，用于 static:///host1:port,host2:port 这类 target 中没有服务名的情况
+// 服务名会写入地址的 ServerName，allocator 依赖它读取对应服务的配置
+func WithServiceName(svcName string) DialOption {
+	return func(name string) (grpc.DialOption, error) {
+		return dialerOption{apply: func(cfg *dialConfig) {
+			cfg.serviceName = svcName
+		}}, nil
+	}
+}
+
+// WithKubernetes 使用 k8s 的 EndpointSlice 做服务发现，name 需要是 k8s://namespace/svcName:port 的格式
+// pod 的标签会带到地址上，可以在 allocator 分组配置的 labels 中使用
+func WithKubernetes(client kubernetes.Interface) DialOption {
+	return func(name string) (grpc.DialOption, error) {
+		if getScheme(name) != k8s.Scheme {
+			return nil, fmt.Errorf("target %s is not a %s target", name, k8s.Scheme)
+		}
+		return grpc.WithResolvers(k8s.NewBuilder(client)), nil
 	}
 }
 
+// WithComposite 合并多个服务发现来源的地址，name 需要是 composite:///svcName 的格式
+// 例如迁移期间部分副本注册在 consul，部分只在静态列表中：
+//
+//	Dial("composite:///svcName", WithComposite(ConsulSource(client, "svcName"), StaticSource("svcName", "1.0.0.1:8080")))
+func WithComposite(sources ...composite.Source) DialOption {
+	return func(name string) (grpc.DialOption, error) {
+		if getScheme(name) != composite.Scheme {
+			return nil, fmt.Errorf("target %s is not a %s target", name, composite.Scheme)
+		}
+		return grpc.WithResolvers(composite.NewBuilder(sources...)), nil
+	}
+}
+
+// ConsulSource 返回 consul 来源
+func ConsulSource(client *consul.Client, svcName string) composite.Source {
+	consul.InitResolver(client)
+	return composite.Source{Name: "consul", Builder: consul.NewBuilder(), Target: "consul://consul/" + svcName}
+}
+
+// StaticSource 返回静态地址列表来源
+func StaticSource(svcName string, addrs ...string) composite.Source {
+	return composite.Source{Name: static.Scheme, Builder: static.NewBuilder(),
+		Target: static.Scheme + "://" + svcName + "/" + strings.Join(addrs, ",")}
+}
+
+// FileSource 返回地址文件来源，path 为绝对路径
+func FileSource(svcName string, path string) composite.Source {
+	return composite.Source{Name: static.FileScheme, Builder: static.NewFileBuilder(),
+		Target: static.FileScheme + "://" + svcName + "/" + strings.TrimPrefix(path, "/")}
+}
+
 // WithBalancerRR 启用客户端负载均衡
 func WithBalancerRR(client *consul.Client) DialOption {
 	return func(name string) (grpc.DialOption, error) {
 		// 借助 consul 的服务注册与服务发现机制，执行负载均衡
 		consul.InitResolver(client)
-		return grpc.WithBalancerName(roundrobin.Name), nil
+		return withBalancerName(roundrobin.Name), nil
 	}
 }
 
+func withBalancerName(balancerName string) dialerOption {
+	return dialerOption{apply: func(cfg *dialConfig) {
+		cfg.balancer = balancerName
+	}}
+}
+
 // Dial 返回带有追踪拦截器的负载平衡的gRPC客户端连接
 // 传入的 name，可以是单独是目标服务名 svcName，也可以是 consul://consul/svcName 的格式
+// 已经带有其他 scheme 的 name 保持不变，如 static://svcName/host1:port,host2:port、file://svcName/path/endpoints.json、
+// dns-srv://127.0.0.1:8600/svcName.service.consul；static:///host1:port,host2:port 需要用 WithServiceName 指定服务名
+// 必须通过 WithTLS、WithTLSFromCA、WithMTLS 设置传输安全，或者用 WithInsecure 显式使用不安全连接
 func Dial(name string, opts ...DialOption) (*grpc.ClientConn, error) {
 	name = addSchemeIfNeeded(name, "consul")
 
@@ -63,18 +185,75 @@ func Dial(name string, opts ...DialOption) (*grpc.ClientConn, error) {
 		}),
 	}
 
-	//设置非安全连接
-	dialopts = append(dialopts, grpc.WithInsecure())
-
 	// 应用可选配置参数
+	var cfg dialConfig
 	for _, fn := range opts {
 		opt, err := fn(name)
 		if err != nil {
 			return nil, fmt.Errorf("options setting err: %v", err)
 		}
+		if do, ok := opt.(dialerOption); ok {
+			do.apply(&cfg)
+			continue
+		}
 		dialopts = append(dialopts, opt)
 	}
 
+	// static、file、dns-srv 不需要外部依赖，只对当前连接注册，无需像 consul 一样全局 InitResolver
+	switch getScheme(name) {
+	case static.Scheme, static.FileScheme:
+		dialopts = append(dialopts, grpc.WithResolvers(static.NewBuilderWithName(cfg.serviceName), static.NewFileBuilder()))
+	case dnssrv.Scheme:
+		dialopts = append(dialopts, grpc.WithResolvers(dnssrv.NewBuilder()))
+	}
+
+	// 负载均衡与调用策略
+	if cfg.balancer != "" {
+		dialopts = append(dialopts, grpc.WithBalancerName(cfg.balancer))
+	}
+	// allocator 需要调用 ID 识别重试，放在拦截器链最前面，同一次调用的所有尝试共用一个调用 ID
+	if cfg.balancer == allocator.Name {
+		cfg.unary = append([]grpc.UnaryClientInterceptor{callIDUnaryInterceptor}, cfg.unary...)
+		cfg.stream = append([]grpc.StreamClientInterceptor{callIDStreamInterceptor}, cfg.stream...)
+	}
+	if cfg.policy != nil {
+		if err := cfg.policy.validate(cfg.balancer); err != nil {
+			return nil, fmt.Errorf("service policy err: %v", err)
+		}
+		sc, err := cfg.policy.serviceConfigJSON(cfg.balancer)
+		if err != nil {
+			return nil, fmt.Errorf("service policy err: %v", err)
+		}
+		dialopts = append(dialopts, grpc.WithDefaultServiceConfig(sc))
+		warnRetryDisabled(cfg.policy)
+		// grpc 不执行 hedgingPolicy，放在拦截器链最后，每次尝试都经过负载均衡
+		if cfg.policy.hasHedging() {
+			cfg.unary = append(cfg.unary, hedgingUnaryInterceptor(cfg.policy))
+		}
+	}
+
+	// 统一安装拦截器链，避免多个选项各自使用 grpc.WithUnaryInterceptor 时互相覆盖
+	if len(cfg.unary) > 0 {
+		dialopts = append(dialopts, grpc.WithChainUnaryInterceptor(cfg.unary...))
+	}
+	if len(cfg.stream) > 0 {
+		dialopts = append(dialopts, grpc.WithChainStreamInterceptor(cfg.stream...))
+	}
+
+	// 设置传输安全
+	switch {
+	case cfg.tlsConfig != nil:
+		tlsConfig := cfg.tlsConfig.Clone()
+		if cfg.serverName != "" {
+			tlsConfig.ServerName = cfg.serverName
+		}
+		dialopts = append(dialopts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	case cfg.insecure:
+		dialopts = append(dialopts, grpc.WithInsecure())
+	default:
+		return nil, fmt.Errorf("dial %s: no transport security set, use WithTLS/WithTLSFromCA/WithMTLS or WithInsecure", name)
+	}
+
 	// 使用gRPC.Dial创建客户端连接
 	conn, err := grpc.Dial(name, dialopts...)
 	if err != nil {
@@ -86,6 +265,10 @@ func Dial(name string, opts ...DialOption) (*grpc.ClientConn, error) {
 
 func addSchemeIfNeeded(target string, scheme string) string {
 	// 标准字格式：scheme://authority/endpoint
+	// 已经带有 scheme 的 target 不做修改
+	if getScheme(target) != "" {
+		return target
+	}
 	// 检查字符串是否已经以 scheme://scheme 开头
 	prefix := scheme + "://" + scheme + "/"
 	if !strings.HasPrefix(target, prefix) {
@@ -94,3 +277,11 @@ func addSchemeIfNeeded(target string, scheme string) string {
 	}
 	return target
 }
+
+// getScheme 返回 target 的 scheme，没有 scheme 时返回空字符串
+func getScheme(target string) string {
+	if i := strings.Index(target, "://"); i > 0 {
+		return target[:i]
+	}
+	return ""
+}
@@ -0,0 +1,123 @@
+package dialer
+
+import (
+	"context"
+	"fmt"
+	"github.com/Chen-Jin-yuan/grpc/allocator"
+	"github.com/opentracing/opentracing-go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddSchemeIfNeeded(t *testing.T) {
+	cases := map[string]string{
+		"exam_svc":                       "consul://consul/exam_svc",
+		"consul://consul/exam_svc":       "consul://consul/exam_svc",
+		"static://exam_svc/1.0.0.1:1":    "static://exam_svc/1.0.0.1:1",
+		"file://exam_svc/etc/svc.json":   "file://exam_svc/etc/svc.json",
+		"dns-srv:///exam_svc.svc.consul": "dns-srv:///exam_svc.svc.consul",
+	}
+	for target, want := range cases {
+		if got := addSchemeIfNeeded(target, "consul"); got != want {
+			t.Errorf("addSchemeIfNeeded(%s) = %s, want %s", target, got, want)
+		}
+	}
+}
+
+// 没有设置传输安全时 Dial 返回错误，WithInsecure 显式开启后可以连接
+func TestDialSecurity(t *testing.T) {
+	_, err := Dial("static://exam_svc/127.0.0.1:1")
+	fmt.Printf("dial without security: %v\n", err)
+	if err == nil {
+		t.Errorf("expect error when no transport security is set")
+	}
+
+	conn, err := Dial("static://exam_svc/127.0.0.1:1", WithInsecure())
+	if err != nil {
+		t.Fatalf("dial with insecure err: %v", err)
+	}
+	_ = conn.Close()
+
+	conn, err = Dial("static://exam_svc/127.0.0.1:1", WithTLS(), WithServerNameOverride(map[string]string{"exam_svc": "example.com"}))
+	if err != nil {
+		t.Fatalf("dial with tls err: %v", err)
+	}
+	_ = conn.Close()
+}
+
+// static:///host1:port 没有服务名，需要 WithServiceName 指定
+func TestDialServiceName(t *testing.T) {
+	_, err := Dial("static:///127.0.0.1:1", WithInsecure())
+	fmt.Printf("dial without service name: %v\n", err)
+	if err == nil {
+		t.Errorf("expect error when no service name is set")
+	}
+
+	conn, err := Dial("static:///127.0.0.1:1", WithInsecure(), WithServiceName("exam_svc"))
+	if err != nil {
+		t.Fatalf("dial with service name err: %v", err)
+	}
+	_ = conn.Close()
+}
+
+// 多个选项的拦截器按选项顺序组成拦截器链，不会互相覆盖
+func TestInterceptorChain(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen err: %v", err)
+	}
+	s := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(s, health.NewServer())
+	go s.Serve(lis)
+	defer s.Stop()
+
+	var order []string
+	record := func(tag string) grpc.UnaryClientInterceptor {
+		return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+			invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			order = append(order, tag)
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+	}
+
+	conn, err := Dial("static://exam_svc/"+lis.Addr().String(), WithInsecure(),
+		WithTracer(opentracing.NoopTracer{}),
+		WithUnaryInterceptors(record("auth"), record("log")),
+		WithUnaryInterceptors(record("metric")))
+	if err != nil {
+		t.Fatalf("dial err: %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err = grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{}); err != nil {
+		t.Fatalf("check err: %v", err)
+	}
+	fmt.Printf("interceptor order: %v\n", order)
+	if strings.Join(order, ",") != "auth,log,metric" {
+		t.Errorf("unexpected interceptor order: %v", order)
+	}
+}
+
+// 调用 ID 每次调用不同，已经设置过的调用 ID 不会被覆盖
+func TestWithCallID(t *testing.T) {
+	ctx1 := withCallID(context.Background())
+	ctx2 := withCallID(context.Background())
+	md1, _ := metadata.FromOutgoingContext(ctx1)
+	md2, _ := metadata.FromOutgoingContext(ctx2)
+	fmt.Printf("call id: %v, %v\n", md1.Get(allocator.CallIDKey), md2.Get(allocator.CallIDKey))
+	if md1.Get(allocator.CallIDKey)[0] == md2.Get(allocator.CallIDKey)[0] {
+		t.Errorf("call id should be unique")
+	}
+	md3, _ := metadata.FromOutgoingContext(withCallID(ctx1))
+	if ids := md3.Get(allocator.CallIDKey); len(ids) != 1 || ids[0] != md1.Get(allocator.CallIDKey)[0] {
+		t.Errorf("call id should be kept, got %v", ids)
+	}
+}
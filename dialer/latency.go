@@ -0,0 +1,85 @@
+package dialer
+
+import (
+	"context"
+	"github.com/Chen-Jin-yuan/grpc/allocator"
+	"github.com/Chen-Jin-yuan/grpc/monitor"
+	"google.golang.org/grpc"
+	"sync"
+	"time"
+)
+
+// WithLatencyHistograms 记录调用延迟，methods 按方法全名记录，groups 按 allocator 选中的 "服务名/分组" 记录，不需要的传 nil
+// 一元调用记录整个调用（包括重试）的时间，流式调用记录从建立流到收到结束或出错的时间，客户端流记录到收到响应为止
+func WithLatencyHistograms(methods *monitor.Histograms, groups *monitor.Histograms) DialOption {
+	return func(name string) (grpc.DialOption, error) {
+		lr := &latencyRecorder{methods: methods, groups: groups}
+		return dialerOption{apply: func(cfg *dialConfig) {
+			cfg.unary = append(cfg.unary, lr.unaryInterceptor)
+			cfg.stream = append(cfg.stream, lr.streamInterceptor)
+		}}, nil
+	}
+}
+
+type latencyRecorder struct {
+	methods *monitor.Histograms
+	groups  *monitor.Histograms
+}
+
+// record 记录一次调用的延迟，没有经过 allocator 的调用不记录分组
+func (lr *latencyRecorder) record(method string, report *allocator.PickReport, d time.Duration) {
+	if lr.methods != nil {
+		lr.methods.GetHistogram(method).Record(d)
+	}
+	if lr.groups != nil {
+		if service, group, addr := report.Get(); addr != "" {
+			lr.groups.GetHistogram(service + "/" + group).Record(d)
+		}
+	}
+}
+
+func (lr *latencyRecorder) unaryInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	ctx, report := allocator.NewPickReportContext(ctx)
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	lr.record(method, report, time.Since(start))
+	return err
+}
+
+func (lr *latencyRecorder) streamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string,
+	streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	ctx, report := allocator.NewPickReportContext(ctx)
+	start := time.Now()
+	s, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		lr.record(method, report, time.Since(start))
+		return nil, err
+	}
+	ls := &latencyStream{ClientStream: s, serverStreams: desc.ServerStreams, done: func() {
+		lr.record(method, report, time.Since(start))
+	}}
+	// 调用方放弃的流（如不再读取就取消的服务端流）在流的 context 结束时记录
+	go func() {
+		<-s.Context().Done()
+		ls.once.Do(ls.done)
+	}()
+	return ls, nil
+}
+
+// latencyStream 在 RecvMsg 返回错误（包括 io.EOF）或流结束时记录一次延迟
+// 没有服务端流的调用（一元、客户端流）只会调用一次 RecvMsg，收到响应时即记录
+type latencyStream struct {
+	grpc.ClientStream
+	serverStreams bool
+	once          sync.Once
+	done          func()
+}
+
+func (s *latencyStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil || !s.serverStreams {
+		s.once.Do(s.done)
+	}
+	return err
+}
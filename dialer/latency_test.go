@@ -0,0 +1,126 @@
+package dialer
+
+import (
+	"context"
+	"fmt"
+	"github.com/Chen-Jin-yuan/grpc/monitor"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistograms(t *testing.T) {
+	hs := &slowHealthServer{slowCalls: 1, delay: 50 * time.Millisecond}
+	addr, stop := startSlowServer(t, hs)
+	defer stop()
+
+	methods, groups := monitor.NewHistograms(), monitor.NewHistograms()
+	conn, err := Dial("static://exam_svc/"+addr, WithInsecure(), WithLatencyHistograms(methods, groups))
+	if err != nil {
+		t.Fatalf("dial err: %v", err)
+	}
+	defer conn.Close()
+
+	client := grpc_health_v1.NewHealthClient(conn)
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err = client.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+		cancel()
+		if err != nil {
+			t.Fatalf("call err: %v", err)
+		}
+	}
+
+	data, _ := methods.ToJSON()
+	fmt.Printf("methods: %+v\n", data)
+	check := data["/grpc.health.v1.Health/Check"]
+	if check.Count != 3 || check.Max < 50 || check.P50 >= 50 {
+		t.Errorf("unexpected latency: %+v", check)
+	}
+	// 没有使用 allocator，不记录分组
+	if len(groups.GetHistogramsData()) != 0 {
+		t.Errorf("expect no group latency, got %+v", groups.GetHistogramsData())
+	}
+}
+
+// collectHandler 客户端流方法：读取全部请求后延迟返回一个响应
+func collectHandler(srv interface{}, stream grpc.ServerStream) error {
+	for {
+		if err := stream.RecvMsg(new(grpc_health_v1.HealthCheckRequest)); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	return stream.SendMsg(&grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING})
+}
+
+var collectServiceDesc = grpc.ServiceDesc{
+	ServiceName: "exam.Latency",
+	HandlerType: (*interface{})(nil),
+	Streams:     []grpc.StreamDesc{{StreamName: "Collect", Handler: collectHandler, ClientStreams: true}},
+}
+
+// 客户端流在收到响应时记录，服务端流被放弃时在流结束时记录
+func TestStreamLatency(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen err: %v", err)
+	}
+	s := grpc.NewServer()
+	s.RegisterService(&collectServiceDesc, struct{}{})
+	grpc_health_v1.RegisterHealthServer(s, &slowHealthServer{})
+	go s.Serve(lis)
+	defer s.Stop()
+
+	methods := monitor.NewHistograms()
+	conn, err := Dial("static://exam_svc/"+lis.Addr().String(), WithInsecure(), WithLatencyHistograms(methods, nil))
+	if err != nil {
+		t.Fatalf("dial err: %v", err)
+	}
+	defer conn.Close()
+
+	// 客户端流只调用一次 RecvMsg
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	stream, err := conn.NewStream(ctx, &collectServiceDesc.Streams[0], "/exam.Latency/Collect")
+	if err != nil {
+		t.Fatalf("new stream err: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = stream.SendMsg(&grpc_health_v1.HealthCheckRequest{}); err != nil {
+			t.Fatalf("send err: %v", err)
+		}
+	}
+	if err = stream.CloseSend(); err != nil {
+		t.Fatalf("close send err: %v", err)
+	}
+	if err = stream.RecvMsg(new(grpc_health_v1.HealthCheckResponse)); err != nil {
+		t.Fatalf("recv err: %v", err)
+	}
+	collect := methods.GetHistogram("/exam.Latency/Collect").GetData()
+	fmt.Printf("client stream latency: %+v\n", collect)
+	if collect.Count != 1 || collect.Max < 50 {
+		t.Errorf("unexpected client stream latency: %+v", collect)
+	}
+
+	// 服务端流建立后不读取就取消
+	watchCtx, watchCancel := context.WithCancel(context.Background())
+	if _, err = grpc_health_v1.NewHealthClient(conn).Watch(watchCtx, &grpc_health_v1.HealthCheckRequest{}); err != nil {
+		t.Fatalf("watch err: %v", err)
+	}
+	watchCancel()
+	watch := methods.GetHistogram("/grpc.health.v1.Health/Watch")
+	deadline := time.Now().Add(time.Second)
+	for watch.Count() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	fmt.Printf("abandoned server stream latency: %+v\n", watch.GetData())
+	if watch.Count() != 1 {
+		t.Errorf("expect the abandoned server stream to be recorded once, got %d", watch.Count())
+	}
+}
@@ -0,0 +1,314 @@
+package dialer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServicePolicy 调用策略，对应 grpc service config 中除负载均衡以外的部分
+// 可以直接在代码中构造，也可以从 JSON 文件读取，文件格式与 grpc service config 相同，例如：
+//
+//	{
+//	  "methodConfig": [{
+//	    "name": [{"service": "pkg.Svc"}],
+//	    "timeout": "1s",
+//	    "waitForReady": true,
+//	    "retryPolicy": {
+//	      "maxAttempts": 3,
+//	      "initialBackoff": "0.1s",
+//	      "maxBackoff": "1s",
+//	      "backoffMultiplier": 2,
+//	      "retryableStatusCodes": ["UNAVAILABLE"]
+//	    }
+//	  }]
+//	}
+type ServicePolicy struct {
+	// LoadBalancingPolicy 为空时使用 WithBalancer、WithAllocator 等选项设置的负载均衡，两者都设置时必须相同
+	LoadBalancingPolicy string           `json:"loadBalancingPolicy,omitempty"`
+	MethodConfig        []MethodConfig   `json:"methodConfig,omitempty"`
+	RetryThrottling     *RetryThrottling `json:"retryThrottling,omitempty"`
+}
+
+// MethodConfig 一组方法的调用策略
+type MethodConfig struct {
+	// Name 匹配的方法，Method 为空匹配服务的所有方法，Service 也为空时匹配所有方法
+	Name         []MethodName `json:"name"`
+	WaitForReady *bool        `json:"waitForReady,omitempty"`
+	// Timeout 单次调用的超时时间，调用方的 deadline 更短时以调用方为准
+	Timeout       Duration       `json:"timeout,omitempty"`
+	RetryPolicy   *RetryPolicy   `json:"retryPolicy,omitempty"`
+	HedgingPolicy *HedgingPolicy `json:"hedgingPolicy,omitempty"`
+}
+
+// MethodName 服务名与方法名，如 {"service": "pkg.Svc", "method": "Get"}
+type MethodName struct {
+	Service string `json:"service"`
+	Method  string `json:"method,omitempty"`
+}
+
+// RetryPolicy 失败后重试，由 grpc 执行，需要设置环境变量 GRPC_GO_RETRY=on
+type RetryPolicy struct {
+	MaxAttempts          int      `json:"maxAttempts"`
+	InitialBackoff       Duration `json:"initialBackoff"`
+	MaxBackoff           Duration `json:"maxBackoff"`
+	BackoffMultiplier    float64  `json:"backoffMultiplier"`
+	RetryableStatusCodes []string `json:"retryableStatusCodes"`
+}
+
+// HedgingPolicy 对冲请求：超过 HedgingDelay 还没有返回时再发送一次，最先成功的结果返回
+// grpc-go 不支持 hedgingPolicy，由 dialer 的拦截器执行，只对一元调用生效
+type HedgingPolicy struct {
+	MaxAttempts  int      `json:"maxAttempts"`
+	HedgingDelay Duration `json:"hedgingDelay,omitempty"`
+	// NonFatalStatusCodes 返回这些状态码时立即发送下一次请求，其他错误直接返回
+	NonFatalStatusCodes []string `json:"nonFatalStatusCodes,omitempty"`
+}
+
+// RetryThrottling 失败率过高时停止重试
+type RetryThrottling struct {
+	MaxTokens  int     `json:"maxTokens"`
+	TokenRatio float64 `json:"tokenRatio"`
+}
+
+// Duration 在 JSON 中表示为 grpc service config 的格式，如 "0.1s"，解析时也接受 "100ms" 这样的写法
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatFloat(time.Duration(d).Seconds(), 'f', -1, 64) + "s")
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// WithServicePolicy 设置重试、对冲、超时等调用策略，与负载均衡配置一起生成默认的 service config
+// 重试和对冲的每次尝试都会重新经过负载均衡，allocator 按相同的 metadata 选择分组，因此仍然落在同一分组内
+func WithServicePolicy(policy *ServicePolicy) DialOption {
+	return func(name string) (grpc.DialOption, error) {
+		return dialerOption{apply: func(cfg *dialConfig) {
+			cfg.policy = policy
+		}}, nil
+	}
+}
+
+// WithServicePolicyFile 从 JSON 文件读取调用策略
+func WithServicePolicyFile(path string) DialOption {
+	return func(name string) (grpc.DialOption, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read %s error: %v", path, err)
+		}
+		var policy ServicePolicy
+		if err = json.Unmarshal(data, &policy); err != nil {
+			return nil, fmt.Errorf("json unmarshal %s error: %v", path, err)
+		}
+		return WithServicePolicy(&policy)(name)
+	}
+}
+
+// validate 检查 grpc 不允许或与拨号选项冲突的配置：同一方法不能同时设置 retryPolicy 和 hedgingPolicy，
+// 单独配置的负载均衡必须与 WithBalancer、WithAllocator 等选项设置的一致
+func (p *ServicePolicy) validate(balancerName string) error {
+	for _, mc := range p.MethodConfig {
+		if mc.RetryPolicy != nil && mc.HedgingPolicy != nil {
+			return fmt.Errorf("method config %+v sets both retryPolicy and hedgingPolicy", mc.Name)
+		}
+	}
+	if p.LoadBalancingPolicy != "" && balancerName != "" && p.LoadBalancingPolicy != balancerName {
+		return fmt.Errorf("loadBalancingPolicy %q conflicts with balancer %q set by dial options", p.LoadBalancingPolicy, balancerName)
+	}
+	return nil
+}
+
+// serviceConfigJSON 生成 service config，负载均衡没有单独配置时使用拨号选项中的负载均衡
+func (p *ServicePolicy) serviceConfigJSON(balancerName string) (string, error) {
+	sc := *p
+	if sc.LoadBalancingPolicy == "" {
+		sc.LoadBalancingPolicy = balancerName
+	}
+	data, err := json.Marshal(&sc)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// hasRetry 是否有方法配置了重试
+func (p *ServicePolicy) hasRetry() bool {
+	for _, mc := range p.MethodConfig {
+		if mc.RetryPolicy != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// hedgingPolicyFor 按 grpc 的规则匹配方法：先匹配服务和方法，再匹配服务，最后匹配默认配置
+func (p *ServicePolicy) hedgingPolicyFor(fullMethodName string) *HedgingPolicy {
+	service, method := splitMethodName(fullMethodName)
+	var serviceMatch, defaultMatch *HedgingPolicy
+	for i := range p.MethodConfig {
+		mc := &p.MethodConfig[i]
+		for _, n := range mc.Name {
+			switch {
+			case n.Service == service && n.Method == method:
+				return mc.HedgingPolicy
+			case n.Service == service && n.Method == "" && serviceMatch == nil:
+				serviceMatch = mc.HedgingPolicy
+			case n.Service == "" && defaultMatch == nil:
+				defaultMatch = mc.HedgingPolicy
+			}
+		}
+	}
+	if serviceMatch != nil {
+		return serviceMatch
+	}
+	return defaultMatch
+}
+
+// hasHedging 是否有方法配置了对冲
+func (p *ServicePolicy) hasHedging() bool {
+	for _, mc := range p.MethodConfig {
+		if mc.HedgingPolicy != nil && mc.HedgingPolicy.MaxAttempts > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// hedgingUnaryInterceptor 按方法的对冲策略发送多次请求，返回第一个成功或不可重试的结果
+func hedgingUnaryInterceptor(policy *ServicePolicy) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		hp := policy.hedgingPolicyFor(method)
+		if hp == nil || hp.MaxAttempts <= 1 {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		return hedge(ctx, hp, func(ctx context.Context, r interface{}) error {
+			return invoker(ctx, method, req, r, cc, opts...)
+		}, reply)
+	}
+}
+
+type hedgeResult struct {
+	reply interface{}
+	err   error
+}
+
+// hedge 每次尝试使用独立的 reply，最先成功的结果拷贝回调用方的 reply
+func hedge(ctx context.Context, hp *HedgingPolicy, call func(ctx context.Context, reply interface{}) error, reply interface{}) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan hedgeResult, hp.MaxAttempts)
+	attempt := func() {
+		r := newReply(reply)
+		results <- hedgeResult{reply: r, err: call(ctx, r)}
+	}
+
+	started, finished := 1, 0
+	go attempt()
+	timer := time.NewTimer(time.Duration(hp.HedgingDelay))
+	defer timer.Stop()
+
+	var lastErr error
+	for finished < started {
+		select {
+		case <-timer.C:
+			if started < hp.MaxAttempts {
+				started++
+				go attempt()
+				timer.Reset(time.Duration(hp.HedgingDelay))
+			}
+		case res := <-results:
+			finished++
+			if res.err == nil {
+				copyReply(reply, res.reply)
+				return nil
+			}
+			lastErr = res.err
+			if !hp.nonFatal(res.err) {
+				return res.err
+			}
+			// 可重试的错误立即发送下一次请求
+			if started < hp.MaxAttempts {
+				started++
+				go attempt()
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(time.Duration(hp.HedgingDelay))
+			}
+		}
+	}
+	return lastErr
+}
+
+// newReply 创建与 reply 同类型的新对象
+func newReply(reply interface{}) interface{} {
+	return reflect.New(reflect.TypeOf(reply).Elem()).Interface()
+}
+
+// copyReply 把 src 的内容拷贝到 dst
+func copyReply(dst interface{}, src interface{}) {
+	if d, ok := dst.(proto.Message); ok {
+		d.Reset()
+		proto.Merge(d, src.(proto.Message))
+		return
+	}
+	reflect.ValueOf(dst).Elem().Set(reflect.ValueOf(src).Elem())
+}
+
+// nonFatal 错误的状态码是否在 NonFatalStatusCodes 中
+func (hp *HedgingPolicy) nonFatal(err error) bool {
+	code := status.Code(err)
+	for _, c := range hp.NonFatalStatusCodes {
+		if strings.EqualFold(c, codeName(code)) || strings.EqualFold(c, code.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+// codeName 返回 service config 中使用的状态码名字，如 UNAVAILABLE、DEADLINE_EXCEEDED
+func codeName(code codes.Code) string {
+	name := code.String()
+	var b strings.Builder
+	for i, r := range name {
+		if i > 0 && r >= 'A' && r <= 'Z' {
+			b.WriteByte('_')
+		}
+		b.WriteRune(r)
+	}
+	return strings.ToUpper(b.String())
+}
+
+// warnRetryDisabled grpc-go 的重试需要环境变量开启，没有开启时 retryPolicy 不会生效
+func warnRetryDisabled(policy *ServicePolicy) {
+	if policy.hasRetry() && !strings.EqualFold(os.Getenv("GRPC_GO_RETRY"), "on") {
+		log.Warn().Msg("retryPolicy is set but GRPC_GO_RETRY is not on, grpc will not retry")
+	}
+}
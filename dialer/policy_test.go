@@ -0,0 +1,195 @@
+package dialer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer/roundrobin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowHealthServer 前 slowCalls 次调用等待 delay 后才返回
+type slowHealthServer struct {
+	calls     int32
+	slowCalls int32
+	delay     time.Duration
+}
+
+func (s *slowHealthServer) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	if atomic.AddInt32(&s.calls, 1) <= s.slowCalls {
+		select {
+		case <-time.After(s.delay):
+		case <-ctx.Done():
+			return nil, status.Error(codes.Canceled, "canceled")
+		}
+	}
+	return &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil
+}
+
+func (s *slowHealthServer) Watch(*grpc_health_v1.HealthCheckRequest, grpc_health_v1.Health_WatchServer) error {
+	return status.Error(codes.Unimplemented, "unimplemented")
+}
+
+func startSlowServer(t *testing.T, hs *slowHealthServer) (string, func()) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen err: %v", err)
+	}
+	s := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(s, hs)
+	go s.Serve(lis)
+	return lis.Addr().String(), s.Stop
+}
+
+func TestServicePolicyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	data := `{"methodConfig": [{
+		"name": [{"service": "grpc.health.v1.Health"}],
+		"timeout": "100ms",
+		"waitForReady": true,
+		"retryPolicy": {"maxAttempts": 3, "initialBackoff": "0.1s", "maxBackoff": "1s",
+			"backoffMultiplier": 2, "retryableStatusCodes": ["UNAVAILABLE"]}
+	}]}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("write err: %v", err)
+	}
+	opt, err := WithServicePolicyFile(path)("exam_svc")
+	if err != nil {
+		t.Fatalf("load policy err: %v", err)
+	}
+	var cfg dialConfig
+	opt.(dialerOption).apply(&cfg)
+
+	sc, err := cfg.policy.serviceConfigJSON("allocator")
+	if err != nil {
+		t.Fatalf("service config err: %v", err)
+	}
+	fmt.Printf("service config: %s\n", sc)
+	var m map[string]interface{}
+	if err = json.Unmarshal([]byte(sc), &m); err != nil {
+		t.Fatalf("invalid service config json: %v", err)
+	}
+	if m["loadBalancingPolicy"] != "allocator" {
+		t.Errorf("expect loadBalancingPolicy allocator, got %v", m["loadBalancingPolicy"])
+	}
+	if !strings.Contains(sc, `"timeout":"0.1s"`) || !strings.Contains(sc, `"initialBackoff":"0.1s"`) {
+		t.Errorf("durations not in grpc format: %s", sc)
+	}
+}
+
+// 方法配置的超时时间对没有设置 deadline 的调用生效
+func TestPolicyTimeout(t *testing.T) {
+	addr, stop := startSlowServer(t, &slowHealthServer{slowCalls: 1, delay: 2 * time.Second})
+	defer stop()
+
+	conn, err := Dial("static://exam_svc/"+addr, WithInsecure(), WithServicePolicy(&ServicePolicy{
+		MethodConfig: []MethodConfig{{
+			Name:    []MethodName{{Service: "grpc.health.v1.Health", Method: "Check"}},
+			Timeout: Duration(100 * time.Millisecond),
+		}},
+	}))
+	if err != nil {
+		t.Fatalf("dial err: %v", err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	_, err = grpc_health_v1.NewHealthClient(conn).Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	fmt.Printf("check with timeout: %v, cost %v\n", err, time.Since(start))
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("expect DeadlineExceeded, got %v", err)
+	}
+}
+
+// 第一次请求超过对冲延迟还没有返回时发送第二次请求，第二次请求的结果先返回
+func TestPolicyHedging(t *testing.T) {
+	hs := &slowHealthServer{slowCalls: 1, delay: 2 * time.Second}
+	addr, stop := startSlowServer(t, hs)
+	defer stop()
+
+	conn, err := Dial("static://exam_svc/"+addr, WithInsecure(), WithServicePolicy(&ServicePolicy{
+		MethodConfig: []MethodConfig{{
+			Name: []MethodName{{Service: "grpc.health.v1.Health"}},
+			HedgingPolicy: &HedgingPolicy{
+				MaxAttempts:         3,
+				HedgingDelay:        Duration(100 * time.Millisecond),
+				NonFatalStatusCodes: []string{"UNAVAILABLE"},
+			},
+		}},
+	}))
+	if err != nil {
+		t.Fatalf("dial err: %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	resp, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	cost := time.Since(start)
+	fmt.Printf("hedged check: %v %v, cost %v, server calls %d\n", resp, err, cost, atomic.LoadInt32(&hs.calls))
+	if err != nil {
+		t.Fatalf("hedged check err: %v", err)
+	}
+	if resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		t.Errorf("unexpected status %v", resp.Status)
+	}
+	if cost > time.Second {
+		t.Errorf("hedged request should not wait for the slow attempt, cost %v", cost)
+	}
+}
+
+func TestCodeName(t *testing.T) {
+	if n := codeName(codes.DeadlineExceeded); n != "DEADLINE_EXCEEDED" {
+		t.Errorf("codeName = %s", n)
+	}
+	hp := &HedgingPolicy{NonFatalStatusCodes: []string{"UNAVAILABLE", "DEADLINE_EXCEEDED"}}
+	if !hp.nonFatal(status.Error(codes.DeadlineExceeded, "")) || hp.nonFatal(status.Error(codes.Internal, "")) {
+		t.Errorf("unexpected nonFatal result")
+	}
+}
+
+// grpc 不允许同一方法同时重试和对冲，单独配置的负载均衡不能与拨号选项冲突
+func TestPolicyConflict(t *testing.T) {
+	both := &ServicePolicy{MethodConfig: []MethodConfig{{
+		Name:          []MethodName{{Service: "grpc.health.v1.Health"}},
+		RetryPolicy:   &RetryPolicy{MaxAttempts: 2, InitialBackoff: Duration(time.Millisecond), MaxBackoff: Duration(time.Millisecond), BackoffMultiplier: 1, RetryableStatusCodes: []string{"UNAVAILABLE"}},
+		HedgingPolicy: &HedgingPolicy{MaxAttempts: 2},
+	}}}
+	_, err := Dial("static://exam_svc/127.0.0.1:1", WithInsecure(), WithServicePolicy(both))
+	fmt.Printf("retry and hedging: %v\n", err)
+	if err == nil || !strings.Contains(err.Error(), "hedgingPolicy") {
+		t.Errorf("expect error for retryPolicy with hedgingPolicy, got %v", err)
+	}
+
+	roundRobin := func(string) (grpc.DialOption, error) { return withBalancerName(roundrobin.Name), nil }
+	pickFirst := &ServicePolicy{LoadBalancingPolicy: "pick_first"}
+	_, err = Dial("static://exam_svc/127.0.0.1:1", WithInsecure(), roundRobin, WithServicePolicy(pickFirst))
+	fmt.Printf("conflicting balancer: %v\n", err)
+	if err == nil || !strings.Contains(err.Error(), "loadBalancingPolicy") {
+		t.Errorf("expect error for conflicting loadBalancingPolicy, got %v", err)
+	}
+
+	// 与拨号选项一致或没有设置负载均衡选项时可以使用
+	for _, opts := range [][]DialOption{
+		{WithInsecure(), roundRobin, WithServicePolicy(&ServicePolicy{LoadBalancingPolicy: roundrobin.Name})},
+		{WithInsecure(), WithServicePolicy(pickFirst)},
+	} {
+		conn, err := Dial("static://exam_svc/127.0.0.1:1", opts...)
+		if err != nil {
+			t.Errorf("dial err: %v", err)
+			continue
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,176 @@
+package dialer
+
+import (
+	"context"
+	"github.com/Chen-Jin-yuan/grpc/allocator"
+	"github.com/opentracing/opentracing-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+	"strings"
+)
+
+// tracerName OpenTelemetry tracer 的名字
+const tracerName = "github.com/Chen-Jin-yuan/grpc/dialer"
+
+// span 中记录 allocator 选择结果的属性名
+const (
+	attrAllocatorService = "allocator.service"
+	attrAllocatorGroup   = "allocator.group"
+	attrAllocatorAddr    = "allocator.addr"
+)
+
+// WithOpenTelemetry 使用 OpenTelemetry 追踪RPC调用，基于 stats.Handler，一元调用和流式调用都会被追踪
+// tp、propagator 为 nil 时使用 otel 的全局配置
+func WithOpenTelemetry(tp trace.TracerProvider, propagator propagation.TextMapPropagator) DialOption {
+	return func(name string) (grpc.DialOption, error) {
+		if tp == nil {
+			tp = otel.GetTracerProvider()
+		}
+		if propagator == nil {
+			propagator = otel.GetTextMapPropagator()
+		}
+		return grpc.WithStatsHandler(&otelStatsHandler{
+			tracer:     tp.Tracer(tracerName),
+			propagator: propagator,
+		}), nil
+	}
+}
+
+// pickTagUnaryInterceptor 在 OpenTracing 的 span 上记录 allocator 选择的分组和地址
+func pickTagUnaryInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	ctx, report := allocator.NewPickReportContext(ctx)
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		setPickTags(span, report)
+	}
+	return err
+}
+
+// pickTagStreamInterceptor 流建立后就已经选择了连接，此时 span 还没有结束
+func pickTagStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string,
+	streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	ctx, report := allocator.NewPickReportContext(ctx)
+	s, err := streamer(ctx, desc, cc, method, opts...)
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		setPickTags(span, report)
+	}
+	return s, err
+}
+
+func setPickTags(span opentracing.Span, report *allocator.PickReport) {
+	service, group, addr := report.Get()
+	if addr == "" {
+		return
+	}
+	span.SetTag(attrAllocatorService, service)
+	span.SetTag(attrAllocatorGroup, group)
+	span.SetTag(attrAllocatorAddr, addr)
+}
+
+// otelStatsHandler 为每个 RPC 创建一个 client span，RPC 结束时结束 span
+type otelStatsHandler struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+func (h *otelStatsHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	service, method := splitMethodName(info.FullMethodName)
+	ctx, _ = allocator.NewPickReportContext(ctx)
+	ctx, _ = h.tracer.Start(ctx, strings.TrimPrefix(info.FullMethodName, "/"),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("rpc.system", "grpc"),
+			attribute.String("rpc.service", service),
+			attribute.String("rpc.method", method),
+		))
+
+	// 把 span 上下文注入到 metadata 中，传递给下游
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = metadata.MD{}
+	}
+	h.propagator.Inject(ctx, metadataCarrier(md))
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+func (h *otelStatsHandler) HandleRPC(ctx context.Context, rs stats.RPCStats) {
+	span := trace.SpanFromContext(ctx)
+	switch rs := rs.(type) {
+	case *stats.OutHeader:
+		// 每次尝试都会选择一次连接，重试时以最后一次为准
+		setPickAttributes(ctx, span)
+	case *stats.End:
+		setPickAttributes(ctx, span)
+		code := status.Code(rs.Error)
+		span.SetAttributes(attribute.Int64("rpc.grpc.status_code", int64(code)))
+		if rs.Error != nil {
+			span.SetStatus(codes.Error, rs.Error.Error())
+		}
+		span.End()
+	}
+}
+
+func (h *otelStatsHandler) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (h *otelStatsHandler) HandleConn(ctx context.Context, cs stats.ConnStats) {
+}
+
+func setPickAttributes(ctx context.Context, span trace.Span) {
+	report := allocator.PickReportFromContext(ctx)
+	if report == nil {
+		return
+	}
+	service, group, addr := report.Get()
+	if addr == "" {
+		return
+	}
+	span.SetAttributes(
+		attribute.String(attrAllocatorService, service),
+		attribute.String(attrAllocatorGroup, group),
+		attribute.String(attrAllocatorAddr, addr),
+	)
+}
+
+// splitMethodName 把 /package.Service/Method 拆分为服务名和方法名
+func splitMethodName(fullMethodName string) (string, string) {
+	name := strings.TrimPrefix(fullMethodName, "/")
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return "unknown", name
+}
+
+// metadataCarrier 让 grpc metadata 满足 propagation.TextMapCarrier 接口
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	values := metadata.MD(c).Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (c metadataCarrier) Set(key string, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,15 @@
+module github.com/Chen-Jin-yuan/grpc/dnssrv
+
+go 1.21.1
+
+require (
+	github.com/rs/zerolog v1.31.0
+	google.golang.org/grpc v1.29.1
+)
+
+require (
+	github.com/golang/protobuf v1.3.3 // indirect
+	github.com/mattn/go-colorable v0.1.13 // indirect
+	github.com/mattn/go-isatty v0.0.19 // indirect
+	golang.org/x/sys v0.12.0 // indirect
+)
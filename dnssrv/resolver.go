@@ -0,0 +1,222 @@
+package dnssrv
+
+import (
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/resolver"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scheme DNS SRV resolver 的 scheme
+const Scheme = "dns-srv"
+
+const (
+	// defaultRefreshInterval 定期重新解析的间隔
+	defaultRefreshInterval = 30 * time.Second
+	// defaultLookupTimeout 单次解析的超时时间
+	defaultLookupTimeout = 10 * time.Second
+	defaultDNSPort       = "53"
+)
+
+// InitResolver 初始化注册 dns-srv resolver
+func InitResolver() {
+	log.Info().Msg("dns-srv init\n")
+	resolver.Register(NewBuilder())
+}
+
+// lookuper 抽象 DNS 查询，便于测试时替换
+type lookuper interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+type srvBuilder struct {
+	interval time.Duration
+	// newLookuper 根据 authority 返回查询器，authority 为空时使用系统配置的 DNS
+	newLookuper func(authority string) (lookuper, error)
+}
+
+type srvResolver struct {
+	wg       sync.WaitGroup
+	cc       resolver.ClientConn
+	lookup   lookuper
+	host     string
+	svcName  string
+	interval time.Duration
+	resolveC chan struct{}
+	quitC    chan struct{}
+}
+
+// NewBuilder 返回 dns-srv resolver 的 builder
+func NewBuilder() resolver.Builder {
+	return &srvBuilder{
+		interval:    defaultRefreshInterval,
+		newLookuper: newNetResolver,
+	}
+}
+
+// Build 构建 resolver
+// 约定: target 形式为 dns-srv://[dnsServer]/srvName，authority 为 DNS 服务器地址，为空时使用系统 DNS
+// 例如 Consul 的 DNS 接口：dns-srv://127.0.0.1:8600/exam_svc.service.consul
+// 服务名取 srvName 中第一个不以 _ 开头的标签，如 _grpc._tcp.exam_svc.default.svc.cluster.local 的服务名为 exam_svc
+func (sb *srvBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	log.Info().Msgf("calling dns-srv build, target: %v\n", target)
+
+	host := strings.TrimSuffix(target.Endpoint, ".")
+	if host == "" {
+		return nil, fmt.Errorf("dns-srv resolver: missing srv name in target")
+	}
+	l, err := sb.newLookuper(target.Authority)
+	if err != nil {
+		return nil, err
+	}
+
+	sr := &srvResolver{
+		cc:       cc,
+		lookup:   l,
+		host:     host,
+		svcName:  serviceNameOf(host),
+		interval: sb.interval,
+		resolveC: make(chan struct{}, 1),
+		quitC:    make(chan struct{}),
+	}
+
+	sr.wg.Add(1)
+	go sr.watcher()
+	return sr, nil
+}
+
+func (sb *srvBuilder) Scheme() string {
+	return Scheme
+}
+
+// watcher 启动时立即解析一次，之后定期刷新，也可以由 ResolveNow 触发
+func (sr *srvResolver) watcher() {
+	defer sr.wg.Done()
+	ticker := time.NewTicker(sr.interval)
+	defer ticker.Stop()
+
+	// last 上一次推送的地址，没有变化时不调用 UpdateState，避免每次刷新都重建 picker
+	var last []resolver.Address
+	for {
+		addrs, err := sr.resolve()
+		if err != nil {
+			log.Error().Msgf("error resolving srv %s: %v\n", sr.host, err)
+			sr.cc.ReportError(err)
+			// 报告错误后恢复时重新推送地址
+			last = nil
+		} else if !sameAddrs(addrs, last) {
+			log.Info().Msgf("dns-srv newAddrs: %v\n", addrs)
+			sr.cc.UpdateState(resolver.State{Addresses: addrs})
+			last = addrs
+		}
+
+		select {
+		case <-sr.quitC:
+			return
+		case <-sr.resolveC:
+		case <-ticker.C:
+		}
+	}
+}
+
+// resolve 查询 SRV 记录，再把每条记录的目标主机解析为 ip
+func (sr *srvResolver) resolve() ([]resolver.Address, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultLookupTimeout)
+	defer cancel()
+
+	// service 与 proto 为空时直接查询 host 的 SRV 记录
+	_, srvs, err := sr.lookup.LookupSRV(ctx, "", "", sr.host)
+	if err != nil {
+		return nil, err
+	}
+
+	var newAddrs []resolver.Address
+	seen := make(map[string]bool)
+	for _, srv := range srvs {
+		target := strings.TrimSuffix(srv.Target, ".")
+		ips, err := sr.lookup.LookupHost(ctx, target)
+		if err != nil {
+			log.Error().Msgf("lookup host %s error: %v", target, err)
+			continue
+		}
+		for _, ip := range ips {
+			addr := net.JoinHostPort(ip, strconv.Itoa(int(srv.Port)))
+			if seen[addr] {
+				continue
+			}
+			seen[addr] = true
+			newAddrs = append(newAddrs, resolver.Address{Addr: addr, ServerName: sr.svcName})
+		}
+	}
+	if len(newAddrs) == 0 {
+		return nil, fmt.Errorf("dns-srv resolver: no address for %s", sr.host)
+	}
+
+	// DNS 返回的记录顺序不固定，排序后才能与上一次的结果比较
+	sort.Slice(newAddrs, func(i, j int) bool {
+		return newAddrs[i].Addr < newAddrs[j].Addr
+	})
+	return newAddrs, nil
+}
+
+// sameAddrs 两次解析的地址是否相同，地址都已经排序
+func sameAddrs(a, b []resolver.Address) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Addr != b[i].Addr || a[i].ServerName != b[i].ServerName {
+			return false
+		}
+	}
+	return true
+}
+
+// ResolveNow 立即重新解析
+func (sr *srvResolver) ResolveNow(opt resolver.ResolveNowOptions) {
+	select {
+	case sr.resolveC <- struct{}{}:
+	default:
+	}
+}
+
+// Close 关闭观察者。
+func (sr *srvResolver) Close() {
+	close(sr.quitC)
+	sr.wg.Wait()
+}
+
+// serviceNameOf 返回 srv 名称中第一个不以 _ 开头的标签
+func serviceNameOf(host string) string {
+	for _, label := range strings.Split(host, ".") {
+		if label != "" && !strings.HasPrefix(label, "_") {
+			return label
+		}
+	}
+	return host
+}
+
+// newNetResolver authority 为空时使用系统 DNS，否则所有查询都发往 authority 指定的服务器
+func newNetResolver(authority string) (lookuper, error) {
+	if authority == "" {
+		return net.DefaultResolver, nil
+	}
+	server := authority
+	if _, _, err := net.SplitHostPort(authority); err != nil {
+		server = net.JoinHostPort(authority, defaultDNSPort)
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}, nil
+}
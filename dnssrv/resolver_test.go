@@ -0,0 +1,178 @@
+package dnssrv
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeClientConn struct {
+	mu      sync.Mutex
+	state   resolver.State
+	updates int
+	updated chan struct{}
+}
+
+func (cc *fakeClientConn) UpdateState(s resolver.State) {
+	cc.mu.Lock()
+	cc.state = s
+	cc.updates++
+	cc.mu.Unlock()
+	select {
+	case cc.updated <- struct{}{}:
+	default:
+	}
+}
+func (cc *fakeClientConn) ReportError(error) {
+}
+func (cc *fakeClientConn) NewAddress(addresses []resolver.Address) {
+	cc.UpdateState(resolver.State{Addresses: addresses})
+}
+func (cc *fakeClientConn) NewServiceConfig(string) {
+}
+func (cc *fakeClientConn) ParseServiceConfig(string) *serviceconfig.ParseResult {
+	return nil
+}
+
+type fakeLookuper struct {
+	mu      sync.Mutex
+	srvs    []*net.SRV
+	hosts   map[string][]string
+	lookups int
+}
+
+func (l *fakeLookuper) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lookups++
+	// 每次返回不同的顺序，模拟 DNS 轮询
+	srvs := make([]*net.SRV, len(l.srvs))
+	for i := range l.srvs {
+		srvs[i] = l.srvs[(i+l.lookups)%len(l.srvs)]
+	}
+	return name, srvs, nil
+}
+func (l *fakeLookuper) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if ips, ok := l.hosts[host]; ok {
+		return ips, nil
+	}
+	return nil, fmt.Errorf("no such host: %s", host)
+}
+
+func TestServiceNameOf(t *testing.T) {
+	cases := map[string]string{
+		"exam_svc.service.consul":                       "exam_svc",
+		"_grpc._tcp.exam_svc.default.svc.cluster.local": "exam_svc",
+		"_only._tcp":                                    "_only._tcp",
+	}
+	for host, want := range cases {
+		if got := serviceNameOf(host); got != want {
+			t.Errorf("serviceNameOf(%s) = %s, want %s", host, got, want)
+		}
+	}
+}
+
+func TestSrvResolver(t *testing.T) {
+	l := &fakeLookuper{
+		srvs: []*net.SRV{
+			{Target: "node2.node.dc1.consul.", Port: 8082},
+			{Target: "node1.node.dc1.consul.", Port: 8081},
+			{Target: "missing.node.dc1.consul.", Port: 8083},
+		},
+		hosts: map[string][]string{
+			"node1.node.dc1.consul": {"1.0.0.1"},
+			"node2.node.dc1.consul": {"1.0.0.2"},
+		},
+	}
+	sb := &srvBuilder{
+		interval:    time.Hour,
+		newLookuper: func(string) (lookuper, error) { return l, nil },
+	}
+	cc := &fakeClientConn{updated: make(chan struct{}, 1)}
+	r, err := sb.Build(resolver.Target{Scheme: Scheme, Authority: "127.0.0.1:8600", Endpoint: "exam_svc.service.consul"},
+		cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("build err: %v", err)
+	}
+	defer r.Close()
+
+	select {
+	case <-cc.updated:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no update from resolver")
+	}
+	cc.mu.Lock()
+	addrs := cc.state.Addresses
+	cc.mu.Unlock()
+	fmt.Printf("dns-srv addrs: %+v\n", addrs)
+	if len(addrs) != 2 || addrs[0].Addr != "1.0.0.1:8081" || addrs[1].Addr != "1.0.0.2:8082" {
+		t.Fatalf("unexpected addrs: %+v", addrs)
+	}
+	if addrs[0].ServerName != "exam_svc" {
+		t.Errorf("expect ServerName exam_svc, got %s", addrs[0].ServerName)
+	}
+}
+
+// 定期刷新的结果没有变化时不推送，记录变化后推送新的地址
+func TestSrvResolverSkipUnchanged(t *testing.T) {
+	l := &fakeLookuper{
+		srvs: []*net.SRV{
+			{Target: "node1.node.dc1.consul.", Port: 8081},
+			{Target: "node2.node.dc1.consul.", Port: 8082},
+		},
+		hosts: map[string][]string{
+			"node1.node.dc1.consul": {"1.0.0.1"},
+			"node2.node.dc1.consul": {"1.0.0.2"},
+			"node3.node.dc1.consul": {"1.0.0.3"},
+		},
+	}
+	sb := &srvBuilder{
+		interval:    5 * time.Millisecond,
+		newLookuper: func(string) (lookuper, error) { return l, nil },
+	}
+	cc := &fakeClientConn{updated: make(chan struct{}, 1)}
+	r, err := sb.Build(resolver.Target{Scheme: Scheme, Endpoint: "exam_svc.service.consul"}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("build err: %v", err)
+	}
+	defer r.Close()
+
+	lookups := func() int {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.lookups
+	}
+	updates := func() (int, []resolver.Address) {
+		cc.mu.Lock()
+		defer cc.mu.Unlock()
+		return cc.updates, cc.state.Addresses
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for lookups() < 5 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	n, addrs := updates()
+	fmt.Printf("lookups: %d, updates: %d, addrs: %+v\n", lookups(), n, addrs)
+	if n != 1 {
+		t.Errorf("expect 1 update for unchanged records, got %d", n)
+	}
+
+	l.mu.Lock()
+	l.srvs = append(l.srvs, &net.SRV{Target: "node3.node.dc1.consul.", Port: 8083})
+	l.mu.Unlock()
+	for time.Now().Before(deadline) {
+		if n, addrs = updates(); n == 2 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	fmt.Printf("updates after change: %d, addrs: %+v\n", n, addrs)
+	if n != 2 || len(addrs) != 3 {
+		t.Errorf("expect a second update with 3 addrs, got %d: %+v", n, addrs)
+	}
+}
@@ -0,0 +1,327 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"github.com/Chen-Jin-yuan/grpc/labels"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/resolver"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scheme k8s resolver 的 scheme
+const Scheme = "k8s"
+
+const (
+	defaultNamespace = "default"
+	// 重新 list/watch 的退避时间
+	minRetryInterval = time.Second
+	maxRetryInterval = 30 * time.Second
+)
+
+type k8sBuilder struct {
+	client kubernetes.Interface
+}
+
+type k8sResolver struct {
+	wg        sync.WaitGroup
+	cc        resolver.ClientConn
+	client    kubernetes.Interface
+	namespace string
+	svcName   string
+	port      string
+
+	// slices 当前服务的所有 EndpointSlice，以名字为键
+	slices map[string]*discoveryv1.EndpointSlice
+	// addrs 上次推送的地址，以 ip:port 为键
+	// 标签不变时复用同一个 resolver.Address，balancer 以整个地址（包括 Attributes 指针）识别 SubConn，重新生成会导致重连
+	addrs map[string]resolver.Address
+
+	// pods 通过 informer 观察 namespace 下的 pod，标签变化时重新推送地址
+	pods     informers.SharedInformerFactory
+	podsList listersv1.PodLister
+	podsC    chan struct{}
+	// refMu 保护 refs，refs 为当前 EndpointSlice 引用的 pod UID，informer 的回调只关心这些 pod
+	refMu sync.Mutex
+	refs  map[types.UID]bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewBuilder 返回 k8s resolver 的 builder
+// client 可以是真实的 clientset，也可以是测试用的 fake.NewSimpleClientset()
+func NewBuilder(client kubernetes.Interface) resolver.Builder {
+	return &k8sBuilder{client: client}
+}
+
+// Build 构建 resolver
+// 约定: target 形式为 k8s://namespace/svcName:port，namespace 为空时使用 default
+// port 可以是端口名或端口号，为空时使用 EndpointSlice 的第一个端口
+func (kb *k8sBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	log.Info().Msgf("calling k8s build, target: %v\n", target)
+
+	svcName, port := target.Endpoint, ""
+	if i := strings.LastIndex(svcName, ":"); i >= 0 {
+		svcName, port = svcName[:i], svcName[i+1:]
+	}
+	if svcName == "" {
+		return nil, fmt.Errorf("k8s resolver: missing service name in target")
+	}
+	namespace := target.Authority
+	if namespace == "" {
+		namespace = defaultNamespace
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	kr := &k8sResolver{
+		cc:        cc,
+		client:    kb.client,
+		namespace: namespace,
+		svcName:   svcName,
+		port:      port,
+		slices:    make(map[string]*discoveryv1.EndpointSlice),
+		addrs:     make(map[string]resolver.Address),
+		podsC:     make(chan struct{}, 1),
+		refs:      make(map[types.UID]bool),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+
+	kr.pods = informers.NewSharedInformerFactoryWithOptions(kb.client, 0, informers.WithNamespace(namespace))
+	podInformer := kr.pods.Core().V1().Pods()
+	kr.podsList = podInformer.Lister()
+	_, err := podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: kr.onPod,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldPod, ok1 := oldObj.(*corev1.Pod)
+			newPod, ok2 := newObj.(*corev1.Pod)
+			if ok1 && ok2 && reflect.DeepEqual(oldPod.Labels, newPod.Labels) {
+				return
+			}
+			kr.onPod(newObj)
+		},
+	})
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("k8s resolver: add pod event handler: %v", err)
+	}
+	kr.pods.Start(ctx.Done())
+
+	kr.wg.Add(1)
+	go kr.watcher()
+	return kr, nil
+}
+
+func (kb *k8sBuilder) Scheme() string {
+	return Scheme
+}
+
+// onPod 当前服务引用的 pod 出现或标签变化时，通知 watcher 重新推送地址
+func (kr *k8sResolver) onPod(obj interface{}) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return
+	}
+	kr.refMu.Lock()
+	referenced := kr.refs[pod.UID]
+	kr.refMu.Unlock()
+	if !referenced {
+		return
+	}
+	select {
+	case kr.podsC <- struct{}{}:
+	default:
+	}
+}
+
+// watcher 先 list 再 watch，watch 中断后退避重试
+func (kr *k8sResolver) watcher() {
+	defer kr.wg.Done()
+	// 等 pod 缓存同步后再推送地址，避免第一次推送时没有标签
+	if !cache.WaitForCacheSync(kr.ctx.Done(), kr.pods.Core().V1().Pods().Informer().HasSynced) {
+		return
+	}
+	retry := minRetryInterval
+	for {
+		err := kr.listAndWatch()
+		if kr.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Error().Msgf("error watching EndpointSlices of %s/%s: %v\n", kr.namespace, kr.svcName, err)
+			kr.cc.ReportError(err)
+		} else {
+			// watch 正常结束（服务端超时关闭），立即重新 watch
+			retry = minRetryInterval
+			continue
+		}
+
+		select {
+		case <-kr.ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+		retry *= 2
+		if retry > maxRetryInterval {
+			retry = maxRetryInterval
+		}
+	}
+}
+
+func (kr *k8sResolver) listAndWatch() error {
+	selector := metav1.ListOptions{LabelSelector: discoveryv1.LabelServiceName + "=" + kr.svcName}
+	sliceClient := kr.client.DiscoveryV1().EndpointSlices(kr.namespace)
+
+	list, err := sliceClient.List(kr.ctx, selector)
+	if err != nil {
+		return err
+	}
+	kr.slices = make(map[string]*discoveryv1.EndpointSlice)
+	for i := range list.Items {
+		kr.slices[list.Items[i].Name] = &list.Items[i]
+	}
+	kr.update()
+
+	selector.ResourceVersion = list.ResourceVersion
+	w, err := sliceClient.Watch(kr.ctx, selector)
+	if err != nil {
+		return err
+	}
+	defer w.Stop()
+
+	for {
+		select {
+		case <-kr.ctx.Done():
+			return nil
+		case <-kr.podsC:
+			kr.update()
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return nil
+			}
+			switch event.Type {
+			case watch.Added, watch.Modified:
+				if slice, ok := event.Object.(*discoveryv1.EndpointSlice); ok {
+					kr.slices[slice.Name] = slice
+				}
+			case watch.Deleted:
+				if slice, ok := event.Object.(*discoveryv1.EndpointSlice); ok {
+					delete(kr.slices, slice.Name)
+				}
+			case watch.Error:
+				return fmt.Errorf("watch error: %v", event.Object)
+			default:
+				continue
+			}
+			kr.update()
+		}
+	}
+}
+
+// update 汇总所有 EndpointSlice 中 ready 的地址，带上 pod 标签后推送
+func (kr *k8sResolver) update() {
+	var newAddrs []resolver.Address
+	addrs := make(map[string]resolver.Address)
+	refs := make(map[types.UID]bool)
+
+	for _, slice := range kr.slices {
+		port, ok := kr.selectPort(slice)
+		if !ok {
+			continue
+		}
+		for _, ep := range slice.Endpoints {
+			// Ready 为 nil 时按 ready 处理
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+				continue
+			}
+			if ep.TargetRef != nil {
+				refs[ep.TargetRef.UID] = true
+			}
+			podLabels := kr.labelsOf(ep)
+			for _, ip := range ep.Addresses {
+				addr := net.JoinHostPort(ip, strconv.Itoa(int(port)))
+				if _, ok := addrs[addr]; ok {
+					continue
+				}
+				a, ok := kr.addrs[addr]
+				if !ok || !reflect.DeepEqual(labels.Labels(a), podLabels) {
+					a = labels.WithLabels(resolver.Address{Addr: addr, ServerName: kr.svcName}, podLabels)
+				}
+				addrs[addr] = a
+				newAddrs = append(newAddrs, a)
+			}
+		}
+	}
+	kr.addrs = addrs
+
+	kr.refMu.Lock()
+	kr.refs = refs
+	kr.refMu.Unlock()
+
+	sort.Slice(newAddrs, func(i, j int) bool {
+		return newAddrs[i].Addr < newAddrs[j].Addr
+	})
+	log.Info().Msgf("k8s newAddrs: %v\n", newAddrs)
+	kr.cc.UpdateState(resolver.State{Addresses: newAddrs})
+}
+
+// selectPort 按端口名或端口号选择端口，未指定时使用第一个端口
+func (kr *k8sResolver) selectPort(slice *discoveryv1.EndpointSlice) (int32, bool) {
+	for _, p := range slice.Ports {
+		if p.Port == nil {
+			continue
+		}
+		if kr.port == "" || (p.Name != nil && *p.Name == kr.port) || strconv.Itoa(int(*p.Port)) == kr.port {
+			return *p.Port, true
+		}
+	}
+	return 0, false
+}
+
+// labelsOf 从 pod 缓存中返回 endpoint 对应 pod 的标签，pod 还不在缓存中时返回 nil
+// pod 进入缓存或标签变化后 informer 会通知重新推送
+func (kr *k8sResolver) labelsOf(ep discoveryv1.Endpoint) map[string]string {
+	ref := ep.TargetRef
+	if ref == nil || ref.Kind != "Pod" {
+		return nil
+	}
+	if ref.Namespace != "" && ref.Namespace != kr.namespace {
+		return nil
+	}
+	pod, err := kr.podsList.Pods(kr.namespace).Get(ref.Name)
+	if err != nil {
+		return nil
+	}
+	// 同名 pod 重建后 UID 会变化，缓存中可能还是旧的 pod
+	if ref.UID != "" && pod.UID != ref.UID {
+		return nil
+	}
+	return pod.Labels
+}
+
+// ResolveNow watch 会推送所有变化，不需要主动刷新
+func (kr *k8sResolver) ResolveNow(opt resolver.ResolveNowOptions) {
+}
+
+// Close 关闭观察者。
+func (kr *k8sResolver) Close() {
+	kr.cancel()
+	kr.wg.Wait()
+	kr.pods.Shutdown()
+}
@@ -0,0 +1,135 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"github.com/Chen-Jin-yuan/grpc/labels"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeClientConn struct {
+	mu    sync.Mutex
+	state resolver.State
+}
+
+func (cc *fakeClientConn) UpdateState(s resolver.State) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.state = s
+}
+func (cc *fakeClientConn) ReportError(error) {
+}
+func (cc *fakeClientConn) NewAddress(addresses []resolver.Address) {
+	cc.UpdateState(resolver.State{Addresses: addresses})
+}
+func (cc *fakeClientConn) NewServiceConfig(string) {
+}
+func (cc *fakeClientConn) ParseServiceConfig(string) *serviceconfig.ParseResult {
+	return nil
+}
+
+// waitAddrs 等待地址数变为 n
+func (cc *fakeClientConn) waitAddrs(n int) []resolver.Address {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		cc.mu.Lock()
+		addrs := cc.state.Addresses
+		cc.mu.Unlock()
+		if len(addrs) == n || time.Now().After(deadline) {
+			return addrs
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newPod(name string, version string) *corev1.Pod {
+	return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name: name, Namespace: "default", UID: types.UID("uid-" + name), Labels: map[string]string{"version": version}}}
+}
+
+func newEndpoint(ip string, pod string, ready bool) discoveryv1.Endpoint {
+	return discoveryv1.Endpoint{
+		Addresses:  []string{ip},
+		Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+		TargetRef:  &corev1.ObjectReference{Kind: "Pod", Name: pod, UID: types.UID("uid-" + pod)},
+	}
+}
+
+func TestK8sResolver(t *testing.T) {
+	portName := "grpc"
+	port := int32(8080)
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "exam-svc-abc", Namespace: "default",
+			Labels: map[string]string{discoveryv1.LabelServiceName: "exam_svc"},
+		},
+		Ports: []discoveryv1.EndpointPort{{Name: &portName, Port: &port}},
+		Endpoints: []discoveryv1.Endpoint{
+			newEndpoint("10.0.0.1", "pod1", true),
+			newEndpoint("10.0.0.2", "pod2", true),
+			newEndpoint("10.0.0.3", "pod3", false),
+		},
+	}
+	client := fake.NewSimpleClientset(slice, newPod("pod1", "v1"), newPod("pod2", "v2"), newPod("pod3", "v2"))
+
+	cc := &fakeClientConn{}
+	r, err := NewBuilder(client).Build(resolver.Target{Scheme: Scheme, Endpoint: "exam_svc:grpc"}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("build err: %v", err)
+	}
+	defer r.Close()
+
+	addrs := cc.waitAddrs(2)
+	fmt.Printf("k8s addrs: %+v\n", addrs)
+	if len(addrs) != 2 || addrs[0].Addr != "10.0.0.1:8080" || addrs[0].ServerName != "exam_svc" {
+		t.Fatalf("unexpected addrs: %+v", addrs)
+	}
+	if v := labels.Labels(addrs[1])["version"]; v != "v2" {
+		t.Errorf("expect pod label version=v2, got %q", v)
+	}
+
+	// pod3 变为 ready 后应该被加入
+	ready := true
+	slice.Endpoints[2].Conditions.Ready = &ready
+	if _, err = client.DiscoveryV1().EndpointSlices("default").Update(context.Background(), slice, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("update slice err: %v", err)
+	}
+	before := addrs
+	addrs = cc.waitAddrs(3)
+	fmt.Printf("k8s addrs after update: %+v\n", addrs)
+	if len(addrs) != 3 {
+		t.Fatalf("expect 3 addresses after pod3 ready, got %d", len(addrs))
+	}
+	// 标签没变的地址保持不变，balancer 不会重建对应的 SubConn
+	if addrs[0] != before[0] || addrs[1] != before[1] {
+		t.Errorf("unchanged addresses should be reused: %+v %+v", before, addrs)
+	}
+
+	// pod2 标签变化后重新推送，只有 pod2 的地址变化
+	pod2 := newPod("pod2", "v3")
+	if _, err = client.CoreV1().Pods("default").Update(context.Background(), pod2, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("update pod err: %v", err)
+	}
+	before = addrs
+	deadline := time.Now().Add(2 * time.Second)
+	for labels.Labels(addrs[1])["version"] != "v3" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		addrs = cc.waitAddrs(3)
+	}
+	fmt.Printf("k8s addrs after pod2 relabel: %+v\n", addrs)
+	if v := labels.Labels(addrs[1])["version"]; v != "v3" {
+		t.Errorf("expect pod label version=v3 after relabel, got %q", v)
+	}
+	if addrs[0] != before[0] || addrs[2] != before[2] {
+		t.Errorf("addresses of other pods should be reused: %+v %+v", before, addrs)
+	}
+}
@@ -0,0 +1,7 @@
+module github.com/Chen-Jin-yuan/grpc/labels
+
+go 1.21.1
+
+require google.golang.org/grpc v1.29.1
+
+require github.com/golang/protobuf v1.3.3 // indirect
@@ -0,0 +1,34 @@
+// Package labels 在 resolver.Address 中携带副本标签。
+// 服务发现（如 k8s 的 pod labels）写入标签，负载均衡（如 allocator 的分组 labels）读取，
+// 两边只依赖这个包，resolver 不需要引入 balancer
+package labels
+
+import (
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+)
+
+// labelsKey 是 resolver.Address.Attributes 中副本标签的键
+type labelsKey struct{}
+
+// WithLabels 返回带有副本标签的地址，labels 为空时原样返回
+func WithLabels(addr resolver.Address, labels map[string]string) resolver.Address {
+	if len(labels) == 0 {
+		return addr
+	}
+	if addr.Attributes == nil {
+		addr.Attributes = attributes.New(labelsKey{}, labels)
+	} else {
+		addr.Attributes = addr.Attributes.WithValues(labelsKey{}, labels)
+	}
+	return addr
+}
+
+// Labels 返回地址携带的副本标签，没有时返回 nil
+func Labels(addr resolver.Address) map[string]string {
+	if addr.Attributes == nil {
+		return nil
+	}
+	labels, _ := addr.Attributes.Value(labelsKey{}).(map[string]string)
+	return labels
+}
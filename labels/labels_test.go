@@ -0,0 +1,32 @@
+package labels
+
+import (
+	"fmt"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+	"testing"
+)
+
+type otherKey struct{}
+
+func TestLabels(t *testing.T) {
+	addr := WithLabels(resolver.Address{Addr: "1.0.0.1:1"}, map[string]string{"version": "v1"})
+	fmt.Printf("labels: %v\n", Labels(addr))
+	if Labels(addr)["version"] != "v1" {
+		t.Errorf("labels not carried by address attributes")
+	}
+
+	// 已有的其他属性保留
+	addr = resolver.Address{Addr: "1.0.0.1:1", Attributes: attributes.New(otherKey{}, "other")}
+	addr = WithLabels(addr, map[string]string{"version": "v2"})
+	if Labels(addr)["version"] != "v2" || addr.Attributes.Value(otherKey{}) != "other" {
+		t.Errorf("unexpected attributes: %v", addr.Attributes)
+	}
+
+	if l := Labels(resolver.Address{Addr: "1.0.0.1:1"}); l != nil {
+		t.Errorf("expect nil labels, got %v", l)
+	}
+	if a := WithLabels(resolver.Address{Addr: "1.0.0.1:1"}, nil); a.Attributes != nil {
+		t.Errorf("empty labels should not add attributes")
+	}
+}
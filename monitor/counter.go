@@ -1,7 +1,282 @@
 package monitor
 
+import (
+	"encoding"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter 以 interface{} 为值的计数器接口，RequestCounter、WindowCounter 都实现了该接口
 type Counter interface {
 	IncrementOfValue(value interface{})
 	GetCountOfValue(value interface{}) int
 	GetData() map[interface{}]int
 }
+
+// Stringer 把键或值转换为 JSON 中的字符串，无法转换时返回错误
+type Stringer[K comparable] func(key K) (string, error)
+
+// KeyString 默认的 Stringer，支持 encoding.TextMarshaler、string、整数、bool 和 fmt.Stringer
+func KeyString[K comparable](key K) (string, error) {
+	switch k := any(key).(type) {
+	case encoding.TextMarshaler:
+		text, err := k.MarshalText()
+		if err != nil {
+			return "", err
+		}
+		return string(text), nil
+	case string:
+		return k, nil
+	case int:
+		return strconv.Itoa(k), nil
+	case int8, int16, int32, int64:
+		return strconv.FormatInt(toInt64(k), 10), nil
+	case uint, uint8, uint16, uint32, uint64, uintptr:
+		return strconv.FormatUint(toUint64(k), 10), nil
+	case bool:
+		return strconv.FormatBool(k), nil
+	case fmt.Stringer:
+		return k.String(), nil
+	}
+	return "", fmt.Errorf("unsupported key type: %T", key)
+}
+
+func toInt64(v any) int64 {
+	switch n := v.(type) {
+	case int8:
+		return int64(n)
+	case int16:
+		return int64(n)
+	case int32:
+		return int64(n)
+	}
+	return v.(int64)
+}
+
+func toUint64(v any) uint64 {
+	switch n := v.(type) {
+	case uint:
+		return uint64(n)
+	case uint8:
+		return uint64(n)
+	case uint16:
+		return uint64(n)
+	case uint32:
+		return uint64(n)
+	case uintptr:
+		return uint64(n)
+	}
+	return v.(uint64)
+}
+
+// KeyCounter 按值计数的泛型计数器，值的类型为 K
+// 每个值的计数原子递增，出现竞争后分散到多个分片上，读取已经存在的值不加锁，适合在 Pick 等热点路径中调用
+type KeyCounter[K comparable] struct {
+	counts   sync.Map // map[K]*shardedCount
+	stringer Stringer[K]
+}
+
+// NewKeyCounter 创建值类型为 K 的计数器，stringer 为 nil 时使用 KeyString
+func NewKeyCounter[K comparable](stringer Stringer[K]) *KeyCounter[K] {
+	if stringer == nil {
+		stringer = KeyString[K]
+	}
+	return &KeyCounter[K]{stringer: stringer}
+}
+
+// count 返回值的计数，值不存在时创建
+func (c *KeyCounter[K]) count(value K) *shardedCount {
+	if sc, ok := c.counts.Load(value); ok {
+		return sc.(*shardedCount)
+	}
+	sc, _ := c.counts.LoadOrStore(value, newShardedCount())
+	return sc.(*shardedCount)
+}
+
+// Inc 值的计数加一
+func (c *KeyCounter[K]) Inc(value K) {
+	c.count(value).add(1)
+}
+
+// Add 值的计数加 delta
+func (c *KeyCounter[K]) Add(value K, delta int64) {
+	c.count(value).add(delta)
+}
+
+// Get 返回值的计数，值不存在时返回 0
+func (c *KeyCounter[K]) Get(value K) int64 {
+	sc, ok := c.counts.Load(value)
+	if !ok {
+		return 0
+	}
+	return sc.(*shardedCount).load()
+}
+
+// Data 返回所有值的计数
+func (c *KeyCounter[K]) Data() map[K]int64 {
+	data := make(map[K]int64)
+	c.counts.Range(func(key, value interface{}) bool {
+		data[key.(K)] = value.(*shardedCount).load()
+		return true
+	})
+	return data
+}
+
+// ToJSON 用 stringer 把值转换为字符串，转换后相同的值计数相加
+func (c *KeyCounter[K]) ToJSON() (map[string]int64, error) {
+	jsonMap := make(map[string]int64)
+	for value, count := range c.Data() {
+		valueStr, err := c.stringer(value)
+		if err != nil {
+			return nil, fmt.Errorf("value key %T: %w", value, err)
+		}
+		jsonMap[valueStr] += count
+	}
+	return jsonMap, nil
+}
+
+// KeyCounters 按键保存计数器的泛型集合，键的类型为 K，计数器的值类型为 V
+type KeyCounters[K comparable, V comparable] struct {
+	counters      sync.Map // map[K]*KeyCounter[V]
+	keyStringer   Stringer[K]
+	valueStringer Stringer[V]
+}
+
+// NewKeyCounters 创建计数器集合，stringer 为 nil 时使用 KeyString，例如：
+//
+//	cs := monitor.NewKeyCounters[string, int](nil, nil)
+//	cs.Get("status").Inc(200)
+func NewKeyCounters[K comparable, V comparable](keyStringer Stringer[K], valueStringer Stringer[V]) *KeyCounters[K, V] {
+	if keyStringer == nil {
+		keyStringer = KeyString[K]
+	}
+	if valueStringer == nil {
+		valueStringer = KeyString[V]
+	}
+	return &KeyCounters[K, V]{keyStringer: keyStringer, valueStringer: valueStringer}
+}
+
+// Get 返回键的计数器，已经存在时不加锁；不存在时 LoadOrStore 保证并发调用拿到同一个计数器
+func (cs *KeyCounters[K, V]) Get(key K) *KeyCounter[V] {
+	if c, ok := cs.counters.Load(key); ok {
+		return c.(*KeyCounter[V])
+	}
+	c, _ := cs.counters.LoadOrStore(key, NewKeyCounter[V](cs.valueStringer))
+	return c.(*KeyCounter[V])
+}
+
+// Data 返回每个键各个值的计数
+func (cs *KeyCounters[K, V]) Data() map[K]map[V]int64 {
+	data := make(map[K]map[V]int64)
+	cs.counters.Range(func(key, value interface{}) bool {
+		data[key.(K)] = value.(*KeyCounter[V]).Data()
+		return true
+	})
+	return data
+}
+
+// Reset 删除所有计数器，之前通过 Get 拿到的计数器不再属于该集合
+func (cs *KeyCounters[K, V]) Reset() {
+	cs.counters.Range(func(key, value interface{}) bool {
+		cs.counters.Delete(key)
+		return true
+	})
+}
+
+// ToJSON 用 stringer 把键和值转换为字符串，转换后相同的键合并
+func (cs *KeyCounters[K, V]) ToJSON() (map[string]map[string]int64, error) {
+	jsonMap := make(map[string]map[string]int64)
+	var err error
+	cs.counters.Range(func(key, value interface{}) bool {
+		var keyStr string
+		keyStr, err = cs.keyStringer(key.(K))
+		if err != nil {
+			err = fmt.Errorf("counter key %T: %w", key, err)
+			return false
+		}
+		var valueMap map[string]int64
+		valueMap, err = value.(*KeyCounter[V]).ToJSON()
+		if err != nil {
+			return false
+		}
+		if jsonMap[keyStr] == nil {
+			jsonMap[keyStr] = valueMap
+			return true
+		}
+		for v, n := range valueMap {
+			jsonMap[keyStr][v] += n
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return jsonMap, nil
+}
+
+// cacheLineSize 分片按缓存行对齐，避免不同分片之间伪共享
+const cacheLineSize = 64
+
+// countShard 一个计数分片，独占一个缓存行
+type countShard struct {
+	n int64
+	_ [cacheLineSize - 8]byte
+}
+
+// shardedCount 一个值的计数。没有竞争时只用 n 计数，第一次 CAS 失败后才创建分片，
+// 分片数为不小于 GOMAXPROCS 的 2 的幂，避免每个不同的值都占用 GOMAXPROCS 个缓存行
+type shardedCount struct {
+	n      int64
+	shards atomic.Pointer[[]countShard]
+}
+
+// countShards 计数分片数，进程启动时按 GOMAXPROCS 确定
+var countShards = func() int {
+	n := 1
+	for n < runtime.GOMAXPROCS(0) && n < 64 {
+		n <<= 1
+	}
+	return n
+}()
+
+func newShardedCount() *shardedCount {
+	return &shardedCount{}
+}
+
+// add 没有分片时 CAS 递增 n，CAS 失败说明有竞争，创建分片后随机选择一个分片递增，
+// math/rand 的全局函数在 go 1.20 之后不加锁
+func (c *shardedCount) add(delta int64) {
+	shards := c.shards.Load()
+	if shards == nil {
+		n := atomic.LoadInt64(&c.n)
+		if atomic.CompareAndSwapInt64(&c.n, n, n+delta) {
+			return
+		}
+		shards = c.grow()
+	}
+	atomic.AddInt64(&(*shards)[rand.Uint32()&uint32(len(*shards)-1)].n, delta)
+}
+
+// grow 创建分片，并发创建时只有一个生效
+func (c *shardedCount) grow() *[]countShard {
+	shards := make([]countShard, countShards)
+	if c.shards.CompareAndSwap(nil, &shards) {
+		return &shards
+	}
+	return c.shards.Load()
+}
+
+// load 返回所有分片的和，与并发的递增之间不是原子的
+func (c *shardedCount) load() int64 {
+	sum := atomic.LoadInt64(&c.n)
+	if shards := c.shards.Load(); shards != nil {
+		for i := range *shards {
+			sum += atomic.LoadInt64(&(*shards)[i].n)
+		}
+	}
+	return sum
+}
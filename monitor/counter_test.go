@@ -0,0 +1,177 @@
+package monitor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// httpStatus 自定义的值类型，通过 encoding.TextMarshaler 输出
+type httpStatus int
+
+func (s httpStatus) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("status-%d", int(s))), nil
+}
+
+func TestTypedCounters(t *testing.T) {
+	// 兼容原有的 Counter 接口
+	var _ Counter = (*RequestCounter)(nil)
+
+	cs := NewKeyCounters[netip.Addr, httpStatus](nil, nil)
+	addr := netip.MustParseAddr("10.0.0.1")
+	cs.Get(addr).Inc(200)
+	cs.Get(addr).Inc(200)
+	cs.Get(addr).Add(503, 3)
+
+	if n := cs.Get(addr).Get(200); n != 2 {
+		t.Errorf("expect 2, got %d", n)
+	}
+	data, err := cs.ToJSON()
+	if err != nil {
+		t.Fatalf("ToJSON err: %v", err)
+	}
+	jsonData, _ := json.Marshal(data)
+	fmt.Printf("data: %s\n", jsonData)
+	if data["10.0.0.1"]["status-200"] != 2 || data["10.0.0.1"]["status-503"] != 3 {
+		t.Errorf("unexpected data: %+v", data)
+	}
+
+	// 自定义 stringer
+	byMillis := NewKeyCounters[string, time.Duration](nil, func(d time.Duration) (string, error) {
+		return fmt.Sprintf("%dms", d.Milliseconds()), nil
+	})
+	byMillis.Get("latency").Inc(10 * time.Millisecond)
+	data, _ = byMillis.ToJSON()
+	fmt.Printf("custom stringer: %+v\n", data)
+	if data["latency"]["10ms"] != 1 {
+		t.Errorf("unexpected data: %+v", data)
+	}
+}
+
+func TestKeyString(t *testing.T) {
+	for key, expect := range map[interface{}]string{
+		"v1": "v1", 10001: "10001", int64(-3): "-3", uint8(7): "7", true: "true",
+		time.Second: "1s", httpStatus(1): "status-1",
+	} {
+		got, err := KeyString(key)
+		if err != nil || got != expect {
+			t.Errorf("KeyString(%v) expect %s, got %s, err: %v", key, expect, got, err)
+		}
+	}
+	if _, err := KeyString[interface{}](struct{ a int }{1}); err == nil {
+		t.Errorf("expect error for struct key")
+	}
+	// 兼容的 RequestCounters 也支持更多的类型
+	rc := NewRequestCounters()
+	rc.GetCounter(int64(1)).IncrementOfValue(httpStatus(2))
+	data, err := rc.ToJSON()
+	fmt.Printf("data: %+v, err: %v\n", data, err)
+	if err != nil || data["1"]["status-2"] != 1 {
+		t.Errorf("unexpected data: %+v", data)
+	}
+	rc.GetCounter("bad").IncrementOfValue(struct{}{})
+	if _, err = rc.ToJSON(); err == nil {
+		t.Errorf("expect ToJSON error for struct value")
+	}
+}
+
+// badStatus 的 MarshalText 总是失败
+type badStatus int
+
+var errBadStatus = errors.New("bad status")
+
+func (s badStatus) MarshalText() ([]byte, error) {
+	return nil, errBadStatus
+}
+
+// stringer 返回的错误被包装后返回，调用方可以看到失败原因
+func TestStringerError(t *testing.T) {
+	errStringer := errors.New("stringer failed")
+	cs := NewKeyCounters[string, int](nil, func(int) (string, error) { return "", errStringer })
+	cs.Get("group").Inc(1)
+	_, err := cs.ToJSON()
+	fmt.Printf("KeyCounters.ToJSON: %v\n", err)
+	if !errors.Is(err, errStringer) {
+		t.Errorf("expect stringer error, got %v", err)
+	}
+	keys := NewKeyCounters[int, string](func(int) (string, error) { return "", errStringer }, nil)
+	keys.Get(1).Inc("v1")
+	if _, err = keys.ToJSON(); !errors.Is(err, errStringer) {
+		t.Errorf("expect stringer error for key, got %v", err)
+	}
+
+	wcs := NewWindowCounters(time.Minute, 6)
+	wcs.GetCounter("group").IncrementOfValue(badStatus(1))
+	_, err = wcs.ToJSON()
+	fmt.Printf("WindowCounters.ToJSON: %v\n", err)
+	if !errors.Is(err, errBadStatus) {
+		t.Errorf("expect MarshalText error, got %v", err)
+	}
+
+	hs := NewHistograms()
+	hs.GetHistogram(badStatus(1)).Record(time.Millisecond)
+	if _, err = hs.ToJSON(); !errors.Is(err, errBadStatus) {
+		t.Errorf("expect MarshalText error for histogram key, got %v", err)
+	}
+}
+
+// 没有竞争的值不创建分片，每个不同的值占用的内存不随 GOMAXPROCS 增长
+func TestShardedCountLazy(t *testing.T) {
+	c := newShardedCount()
+	for i := 0; i < 100; i++ {
+		c.add(1)
+	}
+	if c.shards.Load() != nil || c.load() != 100 {
+		t.Errorf("uncontended count should not be sharded, load %d", c.load())
+	}
+	// 创建分片后已有的计数保留
+	c.grow()
+	c.add(2)
+	if c.load() != 102 {
+		t.Errorf("expect 102 after grow, got %d", c.load())
+	}
+
+	// 并发递增不丢失计数
+	c = newShardedCount()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10000; i++ {
+				c.add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	fmt.Printf("concurrent count: %d, sharded: %v\n", c.load(), c.shards.Load() != nil)
+	if c.load() != 80000 {
+		t.Errorf("expect 80000, got %d", c.load())
+	}
+
+	// 大量不同的值，平均每个值分配的内存；按 64 个分片计算，与测试机器的核数无关
+	defer func(n int) { countShards = n }(countShards)
+	countShards = 64
+	kc := NewKeyCounter[string](nil)
+	values := make([]string, 10000)
+	for i := range values {
+		values[i] = "value-" + strconv.Itoa(i)
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for _, v := range values {
+		kc.Inc(v)
+	}
+	runtime.ReadMemStats(&after)
+	perValue := (after.TotalAlloc - before.TotalAlloc) / uint64(len(values))
+	fmt.Printf("bytes per value: %d\n", perValue)
+	if perValue > 256 {
+		t.Errorf("expect at most 256 bytes per value, got %d", perValue)
+	}
+}
@@ -0,0 +1,253 @@
+package monitor
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 直方图的桶按指数增长：第 i 个桶的上界为 histogramMin * histogramGrowth^i
+// 增长因子 2^(1/8) 时相对误差不超过约 9%，从 1 微秒到 1 小时只需要约 260 个桶，桶按需创建
+const (
+	histogramMin    = time.Microsecond
+	histogramGrowth = 1.0905077326652577 // 2^(1/8)
+)
+
+var logHistogramGrowth = math.Log(histogramGrowth)
+
+// Histograms 按键保存延迟直方图，例如按方法名、按 allocator 分组
+type Histograms struct {
+	// 读写互斥锁
+	mu         sync.RWMutex
+	histograms map[interface{}]*Histogram
+}
+
+// Histogram 指数分桶的延迟直方图，相同分桶方式的直方图可以直接合并
+type Histogram struct {
+	// 读写互斥锁
+	mu     sync.RWMutex
+	counts map[int]int64
+	count  int64
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+}
+
+// HistogramData 直方图的统计结果，时间单位为毫秒
+type HistogramData struct {
+	Count int64   `json:"count"`
+	Min   float64 `json:"min_ms"`
+	Max   float64 `json:"max_ms"`
+	Mean  float64 `json:"mean_ms"`
+	P50   float64 `json:"p50_ms"`
+	P90   float64 `json:"p90_ms"`
+	P99   float64 `json:"p99_ms"`
+}
+
+func NewHistogram() *Histogram {
+	return &Histogram{
+		counts: make(map[int]int64),
+	}
+}
+
+// bucketIndex 返回延迟所在的桶，小于 histogramMin 的延迟都在第 0 个桶
+func bucketIndex(d time.Duration) int {
+	if d <= histogramMin {
+		return 0
+	}
+	return int(math.Ceil(math.Log(float64(d)/float64(histogramMin)) / logHistogramGrowth))
+}
+
+// bucketUpper 返回桶的上界
+func bucketUpper(index int) time.Duration {
+	return time.Duration(float64(histogramMin) * math.Pow(histogramGrowth, float64(index)))
+}
+
+// Record 记录一次延迟
+func (h *Histogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[bucketIndex(d)]++
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.count++
+	h.sum += d
+}
+
+// Merge 把 other 的记录合并到 h 中，先复制 other 的记录，不同时持有两个直方图的锁
+func (h *Histogram) Merge(other *Histogram) {
+	if other == nil || other == h {
+		return
+	}
+	other.mu.RLock()
+	counts := make(map[int]int64, len(other.counts))
+	for index, n := range other.counts {
+		counts[index] = n
+	}
+	count, sum, min, max := other.count, other.sum, other.min, other.max
+	other.mu.RUnlock()
+	if count == 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for index, n := range counts {
+		h.counts[index] += n
+	}
+	if h.count == 0 || min < h.min {
+		h.min = min
+	}
+	if max > h.max {
+		h.max = max
+	}
+	h.count += count
+	h.sum += sum
+}
+
+// Count 返回记录的次数
+func (h *Histogram) Count() int64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.count
+}
+
+// Quantile 返回分位数，q 取值 0 到 1，例如 0.99 为 p99；返回所在桶的上界，并限制在最小值和最大值之间
+func (h *Histogram) Quantile(q float64) time.Duration {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.quantileLocked(q)
+}
+
+func (h *Histogram) quantileLocked(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	if q <= 0 {
+		return h.min
+	}
+	if q >= 1 {
+		return h.max
+	}
+	indexes := make([]int, 0, len(h.counts))
+	for index := range h.counts {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	// 第 rank 个记录所在的桶
+	rank := int64(math.Ceil(q * float64(h.count)))
+	var seen int64
+	for _, index := range indexes {
+		seen += h.counts[index]
+		if seen >= rank {
+			d := bucketUpper(index)
+			if d > h.max {
+				d = h.max
+			}
+			if d < h.min {
+				d = h.min
+			}
+			return d
+		}
+	}
+	return h.max
+}
+
+// GetData 返回次数、最小值、最大值、平均值和 p50/p90/p99
+func (h *Histogram) GetData() HistogramData {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.count == 0 {
+		return HistogramData{}
+	}
+	return HistogramData{
+		Count: h.count,
+		Min:   milliseconds(h.min),
+		Max:   milliseconds(h.max),
+		Mean:  milliseconds(h.sum / time.Duration(h.count)),
+		P50:   milliseconds(h.quantileLocked(0.5)),
+		P90:   milliseconds(h.quantileLocked(0.9)),
+		P99:   milliseconds(h.quantileLocked(0.99)),
+	}
+}
+
+// Reset 清空记录
+func (h *Histogram) Reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts = make(map[int]int64)
+	h.count = 0
+	h.sum = 0
+	h.min = 0
+	h.max = 0
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func NewHistograms() *Histograms {
+	return &Histograms{
+		histograms: make(map[interface{}]*Histogram),
+	}
+}
+
+func (hs *Histograms) GetHistogram(key interface{}) *Histogram {
+	// 加写锁防止同时 NewHistogram
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	if hs.histograms[key] == nil {
+		hs.histograms[key] = NewHistogram()
+	}
+	return hs.histograms[key]
+}
+
+// Merge 按键合并 other 的直方图，例如汇总多个副本的统计
+func (hs *Histograms) Merge(other *Histograms) {
+	if other == nil || other == hs {
+		return
+	}
+	other.mu.RLock()
+	histograms := make(map[interface{}]*Histogram, len(other.histograms))
+	for key, h := range other.histograms {
+		histograms[key] = h
+	}
+	other.mu.RUnlock()
+	for key, h := range histograms {
+		hs.GetHistogram(key).Merge(h)
+	}
+}
+
+// GetHistogramsData 返回每个键的统计结果
+func (hs *Histograms) GetHistogramsData() map[interface{}]HistogramData {
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+	data := make(map[interface{}]HistogramData)
+	for key, h := range hs.histograms {
+		data[key] = h.GetData()
+	}
+	return data
+}
+
+// ToJSON 键支持 KeyString 能转换的类型
+func (hs *Histograms) ToJSON() (map[string]HistogramData, error) {
+	jsonMap := make(map[string]HistogramData)
+	for key, data := range hs.GetHistogramsData() {
+		keyStr, err := KeyString(key)
+		if err != nil {
+			return nil, fmt.Errorf("histogram key %T: %w", key, err)
+		}
+		jsonMap[keyStr] = data
+	}
+	return jsonMap, nil
+}
@@ -0,0 +1,61 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram()
+	// 1ms 到 100ms 各一次
+	for i := 1; i <= 100; i++ {
+		h.Record(time.Duration(i) * time.Millisecond)
+	}
+	data := h.GetData()
+	fmt.Printf("data: %+v\n", data)
+	if data.Count != 100 || data.Min != 1 || data.Max != 100 || data.Mean != 50.5 {
+		t.Errorf("unexpected data: %+v", data)
+	}
+	// 分位数的相对误差不超过一个桶的增长
+	for q, expect := range map[float64]float64{0.5: 50, 0.9: 90, 0.99: 99} {
+		got := milliseconds(h.Quantile(q))
+		if got < expect || got > expect*histogramGrowth {
+			t.Errorf("p%v expect about %v, got %v", q*100, expect, got)
+		}
+	}
+
+	// 合并两个直方图
+	other := NewHistogram()
+	for i := 0; i < 100; i++ {
+		other.Record(time.Second)
+	}
+	h.Merge(other)
+	fmt.Printf("merged: %+v\n", h.GetData())
+	if h.Count() != 200 || h.Quantile(0.5) < 100*time.Millisecond || h.Quantile(0.99) != time.Second {
+		t.Errorf("unexpected merged data: %+v", h.GetData())
+	}
+}
+
+func TestHistograms(t *testing.T) {
+	hs := NewHistograms()
+	hs.GetHistogram("/pkg.Svc/Get").Record(2 * time.Millisecond)
+	hs.GetHistogram("/pkg.Svc/Get").Record(4 * time.Millisecond)
+	hs.GetHistogram(10001).Record(time.Millisecond)
+
+	replica := NewHistograms()
+	replica.GetHistogram("/pkg.Svc/Get").Record(6 * time.Millisecond)
+	replica.GetHistogram("/pkg.Svc/Put").Record(time.Millisecond)
+	hs.Merge(replica)
+
+	data, err := hs.ToJSON()
+	if err != nil {
+		t.Fatalf("ToJSON err: %v", err)
+	}
+	jsonData, _ := json.Marshal(data)
+	fmt.Printf("data: %s\n", jsonData)
+	if data["/pkg.Svc/Get"].Count != 3 || data["/pkg.Svc/Get"].Mean != 4 || data["/pkg.Svc/Put"].Count != 1 || data["10001"].Count != 1 {
+		t.Errorf("unexpected data: %+v", data)
+	}
+}
@@ -0,0 +1,65 @@
+package monitor
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"strings"
+)
+
+// 服务端拦截器使用的计数器键，grpc- 前缀的 metadata 键由 grpc 保留，不会与业务的 metadata 键冲突
+const (
+	// MethodKey 按方法全名计数，如 /pkg.Svc/Method
+	MethodKey = "grpc-method"
+	// CodeKey 按状态码计数，使用 codes.Code 的字符串形式，如 OK、Unavailable
+	CodeKey = "grpc-code"
+)
+
+// UnaryServerInterceptor 统计收到的一元调用：按方法、状态码计数，metadataKeys 中的每个键按其每个值计数
+// 与 allocator 分组配置的 selector 使用相同的 metadata 键，可以看到路由到本服务的请求构成，例如：
+//
+//	rcs := monitor.NewRequestCounters()
+//	s := grpc.NewServer(grpc.UnaryInterceptor(monitor.UnaryServerInterceptor(rcs, "request-type")))
+func UnaryServerInterceptor(rcs *RequestCounters, metadataKeys ...string) grpc.UnaryServerInterceptor {
+	keys := lowerKeys(metadataKeys)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		resp, err := handler(ctx, req)
+		countRequest(rcs, ctx, info.FullMethod, err, keys)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor 统计收到的流式调用，流结束时计数
+func StreamServerInterceptor(rcs *RequestCounters, metadataKeys ...string) grpc.StreamServerInterceptor {
+	keys := lowerKeys(metadataKeys)
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		err := handler(srv, ss)
+		countRequest(rcs, ss.Context(), info.FullMethod, err, keys)
+		return err
+	}
+}
+
+// lowerKeys grpc 的 metadata 键都是小写
+func lowerKeys(keys []string) []string {
+	lower := make([]string, len(keys))
+	for i, key := range keys {
+		lower[i] = strings.ToLower(key)
+	}
+	return lower
+}
+
+// countRequest 一个请求的方法、状态码各计数一次，metadata 中每个键的每个值都会被记录一次
+func countRequest(rcs *RequestCounters, ctx context.Context, method string, err error, keys []string) {
+	rcs.GetCounter(MethodKey).IncrementOfValue(method)
+	rcs.GetCounter(CodeKey).IncrementOfValue(status.Code(err).String())
+	if len(keys) == 0 {
+		return
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, key := range keys {
+		for _, value := range md.Get(key) {
+			rcs.GetCounter(key).IncrementOfValue(value)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// examHealthServer Check 对 service 为 bad 的请求返回 NOT_FOUND，Watch 发送一次状态后结束
+type examHealthServer struct{}
+
+func (s *examHealthServer) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	if req.Service == "bad" {
+		return nil, status.Error(codes.NotFound, "unknown service")
+	}
+	return &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil
+}
+
+func (s *examHealthServer) Watch(req *grpc_health_v1.HealthCheckRequest, ws grpc_health_v1.Health_WatchServer) error {
+	return ws.Send(&grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING})
+}
+
+func TestServerInterceptors(t *testing.T) {
+	rcs := NewRequestCounters()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen err: %v", err)
+	}
+	s := grpc.NewServer(
+		grpc.UnaryInterceptor(UnaryServerInterceptor(rcs, "Request-Type")),
+		grpc.StreamInterceptor(StreamServerInterceptor(rcs, "request-type")),
+	)
+	grpc_health_v1.RegisterHealthServer(s, &examHealthServer{})
+	go s.Serve(lis)
+	defer s.Stop()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("dial err: %v", err)
+	}
+	defer conn.Close()
+	client := grpc_health_v1.NewHealthClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	v1 := metadata.AppendToOutgoingContext(ctx, "request-type", "v1")
+	client.Check(v1, &grpc_health_v1.HealthCheckRequest{})
+	client.Check(v1, &grpc_health_v1.HealthCheckRequest{Service: "bad"})
+	client.Check(metadata.AppendToOutgoingContext(ctx, "request-type", "v2"), &grpc_health_v1.HealthCheckRequest{})
+
+	stream, err := client.Watch(v1, &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("watch err: %v", err)
+	}
+	for {
+		if _, err = stream.Recv(); err != nil {
+			if err != io.EOF {
+				t.Fatalf("recv err: %v", err)
+			}
+			break
+		}
+	}
+
+	data, err := rcs.ToJSON()
+	if err != nil {
+		t.Fatalf("ToJSON err: %v", err)
+	}
+	fmt.Printf("data: %+v\n", data)
+	if data[MethodKey]["/grpc.health.v1.Health/Check"] != 3 || data[MethodKey]["/grpc.health.v1.Health/Watch"] != 1 {
+		t.Errorf("unexpected method counts: %+v", data[MethodKey])
+	}
+	if data[CodeKey]["OK"] != 3 || data[CodeKey]["NotFound"] != 1 {
+		t.Errorf("unexpected code counts: %+v", data[CodeKey])
+	}
+	if data["request-type"]["v1"] != 3 || data["request-type"]["v2"] != 1 {
+		t.Errorf("unexpected request-type counts: %+v", data["request-type"])
+	}
+}
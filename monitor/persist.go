@@ -0,0 +1,327 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 快照中键和值的类型，string 和 int 恢复后与原来相等
+// 其他类型（如 encoding.TextMarshaler、int64）用计数器的 stringer 转换为 text，恢复后为字符串
+const (
+	kindString = "string"
+	kindInt    = "int"
+	kindText   = "text"
+)
+
+// snapshotMagic 二进制快照的文件头，最后一个字节为格式版本
+var snapshotMagic = []byte("MCS\x01")
+
+// CountersSnapshot RequestCounters 的快照，可以编码为 JSON 或紧凑的二进制格式保存，重启后恢复
+type CountersSnapshot struct {
+	Time    time.Time       `json:"time"`
+	Entries []SnapshotEntry `json:"entries"`
+}
+
+// SnapshotEntry 一个键的一个值的计数，记录键和值的类型，恢复后 GetCounter(10001) 与 GetCounter("10001") 仍然不同
+type SnapshotEntry struct {
+	Key       string `json:"key"`
+	KeyKind   string `json:"keyKind"`
+	Value     string `json:"value"`
+	ValueKind string `json:"valueKind"`
+	Count     int64  `json:"count"`
+}
+
+func encodeSnapshotKey(key interface{}, stringer Stringer[interface{}]) (string, string, error) {
+	switch k := key.(type) {
+	case string:
+		return k, kindString, nil
+	case int:
+		return fmt.Sprint(k), kindInt, nil
+	}
+	text, err := stringer(key)
+	if err != nil {
+		return "", "", fmt.Errorf("snapshot key %T: %w", key, err)
+	}
+	return text, kindText, nil
+}
+
+func decodeSnapshotKey(s string, kind string) (interface{}, error) {
+	switch kind {
+	case kindString, kindText:
+		return s, nil
+	case kindInt:
+		var n int
+		if _, err := fmt.Sscan(s, &n); err != nil {
+			return nil, fmt.Errorf("invalid int key %q: %v", s, err)
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("unsupported key kind in snapshot: %q", kind)
+}
+
+// Snapshot 返回当前计数的快照，条目按键、值排序
+// string 和 int 以外的键和值用计数器的 stringer 转换为文本，与 ToJSON 支持的类型一致
+func (rcs *RequestCounters) Snapshot() (*CountersSnapshot, error) {
+	s := &CountersSnapshot{Time: time.Now()}
+	cs := rcs.Typed()
+	for key, counts := range cs.Data() {
+		keyStr, keyKind, err := encodeSnapshotKey(key, cs.keyStringer)
+		if err != nil {
+			return nil, err
+		}
+		for value, count := range counts {
+			valueStr, valueKind, err := encodeSnapshotKey(value, cs.valueStringer)
+			if err != nil {
+				return nil, err
+			}
+			s.Entries = append(s.Entries, SnapshotEntry{Key: keyStr, KeyKind: keyKind,
+				Value: valueStr, ValueKind: valueKind, Count: count})
+		}
+	}
+	sort.Slice(s.Entries, func(i, j int) bool {
+		a, b := s.Entries[i], s.Entries[j]
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		return a.Value < b.Value
+	})
+	return s, nil
+}
+
+// Merge 把快照的计数加到当前计数上，多个副本的快照依次 Merge 到同一个 RequestCounters 得到汇总的视图
+func (rcs *RequestCounters) Merge(s *CountersSnapshot) error {
+	for _, e := range s.Entries {
+		key, err := decodeSnapshotKey(e.Key, e.KeyKind)
+		if err != nil {
+			return err
+		}
+		value, err := decodeSnapshotKey(e.Value, e.ValueKind)
+		if err != nil {
+			return err
+		}
+		rcs.Typed().Get(key).Add(value, e.Count)
+	}
+	return nil
+}
+
+// MergeCounters 把另一个 RequestCounters 的计数加到当前计数上，不要求键的类型
+func (rcs *RequestCounters) MergeCounters(other *RequestCounters) {
+	for key, counts := range other.Typed().Data() {
+		for value, count := range counts {
+			rcs.Typed().Get(key).Add(value, count)
+		}
+	}
+}
+
+// Restore 用快照替换当前计数，应在开始计数前调用，与并发的计数之间不是原子的
+func (rcs *RequestCounters) Restore(s *CountersSnapshot) error {
+	rcs.Typed().Reset()
+	return rcs.Merge(s)
+}
+
+// MarshalBinary 紧凑的二进制格式：文件头、时间、条目数，每个条目为键、值和计数，字符串以长度为前缀，整数使用 varint
+func (s *CountersSnapshot) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(snapshotMagic)
+	buf.Write(binary.AppendVarint(nil, s.Time.UnixNano()))
+	buf.Write(binary.AppendUvarint(nil, uint64(len(s.Entries))))
+	for _, e := range s.Entries {
+		for _, field := range []struct{ s, kind string }{{e.Key, e.KeyKind}, {e.Value, e.ValueKind}} {
+			switch field.kind {
+			case kindString, kindText:
+				// text 与 string 的编码相同，只是标记不同
+				if field.kind == kindString {
+					buf.WriteByte('s')
+				} else {
+					buf.WriteByte('t')
+				}
+				buf.Write(binary.AppendUvarint(nil, uint64(len(field.s))))
+				buf.WriteString(field.s)
+			case kindInt:
+				var n int64
+				if _, err := fmt.Sscan(field.s, &n); err != nil {
+					return nil, fmt.Errorf("invalid int key %q: %v", field.s, err)
+				}
+				buf.WriteByte('i')
+				buf.Write(binary.AppendVarint(nil, n))
+			default:
+				return nil, fmt.Errorf("unsupported key kind in snapshot: %q", field.kind)
+			}
+		}
+		buf.Write(binary.AppendVarint(nil, e.Count))
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary 解析 MarshalBinary 的输出
+func (s *CountersSnapshot) UnmarshalBinary(data []byte) error {
+	if !bytes.HasPrefix(data, snapshotMagic) {
+		return errors.New("not a counters snapshot")
+	}
+	r := bytes.NewReader(data[len(snapshotMagic):])
+	nanos, err := binary.ReadVarint(r)
+	if err != nil {
+		return fmt.Errorf("read snapshot time: %v", err)
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return fmt.Errorf("read snapshot entries: %v", err)
+	}
+	readKey := func() (string, string, error) {
+		tag, err := r.ReadByte()
+		if err != nil {
+			return "", "", err
+		}
+		switch tag {
+		case 's', 't':
+			size, err := binary.ReadUvarint(r)
+			if err != nil {
+				return "", "", err
+			}
+			if size > uint64(r.Len()) {
+				return "", "", errors.New("string length out of range")
+			}
+			b := make([]byte, size)
+			if _, err = io.ReadFull(r, b); err != nil {
+				return "", "", err
+			}
+			if tag == 't' {
+				return string(b), kindText, nil
+			}
+			return string(b), kindString, nil
+		case 'i':
+			v, err := binary.ReadVarint(r)
+			if err != nil {
+				return "", "", err
+			}
+			return fmt.Sprint(v), kindInt, nil
+		}
+		return "", "", fmt.Errorf("unknown key tag %q", tag)
+	}
+
+	s.Time = time.Unix(0, nanos)
+	s.Entries = nil
+	for i := uint64(0); i < n; i++ {
+		var e SnapshotEntry
+		if e.Key, e.KeyKind, err = readKey(); err != nil {
+			return fmt.Errorf("read entry %d key: %v", i, err)
+		}
+		if e.Value, e.ValueKind, err = readKey(); err != nil {
+			return fmt.Errorf("read entry %d value: %v", i, err)
+		}
+		if e.Count, err = binary.ReadVarint(r); err != nil {
+			return fmt.Errorf("read entry %d count: %v", i, err)
+		}
+		s.Entries = append(s.Entries, e)
+	}
+	return nil
+}
+
+// isJSONPath 以 .json 结尾的文件使用 JSON 格式，其他使用二进制格式
+func isJSONPath(path string) bool {
+	return strings.HasSuffix(strings.ToLower(path), ".json")
+}
+
+// SaveFile 保存快照到文件，先写入同目录下的临时文件再重命名，进程在写入过程中退出也不会留下不完整的文件
+func (rcs *RequestCounters) SaveFile(path string) error {
+	s, err := rcs.Snapshot()
+	if err != nil {
+		return err
+	}
+	var data []byte
+	if isJSONPath(path) {
+		data, err = json.Marshal(s)
+	} else {
+		data, err = s.MarshalBinary()
+	}
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	// 重命名成功后临时文件已经不存在，Remove 不会影响目标文件
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadFile 从文件恢复计数，文件不存在时（如第一次启动）不做修改并返回 nil
+func (rcs *RequestCounters) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var s CountersSnapshot
+	if isJSONPath(path) {
+		err = json.Unmarshal(data, &s)
+	} else {
+		err = s.UnmarshalBinary(data)
+	}
+	if err != nil {
+		return fmt.Errorf("load counters from %s: %v", path, err)
+	}
+	return rcs.Restore(&s)
+}
+
+// StartFlush 每隔 interval 把计数保存到文件，返回的 stop 函数停止后台保存并最后保存一次，多次调用只生效一次，例如：
+//
+//	rcs := monitor.NewRequestCounters()
+//	if err := rcs.LoadFile("/data/counters.bin"); err != nil { ... }
+//	stop := rcs.StartFlush("/data/counters.bin", 10*time.Second)
+//	defer stop()
+func (rcs *RequestCounters) StartFlush(path string, interval time.Duration) (stop func() error) {
+	quitC := make(chan struct{})
+	doneC := make(chan struct{})
+	go func() {
+		defer close(doneC)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quitC:
+				return
+			case <-ticker.C:
+				if err := rcs.SaveFile(path); err != nil {
+					log.Error().Msgf("flush counters to %s err: %v\n", path, err)
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	var err error
+	return func() error {
+		once.Do(func() {
+			close(quitC)
+			<-doneC
+			err = rcs.SaveFile(path)
+		})
+		return err
+	}
+}
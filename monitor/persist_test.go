@@ -0,0 +1,137 @@
+package monitor
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newExamCounters() *RequestCounters {
+	rc := NewRequestCounters()
+	rc.GetCounter("request-type").IncrementOfValue("v1")
+	rc.GetCounter("request-type").IncrementOfValue("v1")
+	rc.GetCounter("request-type").IncrementOfValue("v2")
+	rc.GetCounter(10001).IncrementOfValue(3)
+	rc.GetCounter("10001").IncrementOfValue("3")
+	return rc
+}
+
+func TestSaveAndLoadFile(t *testing.T) {
+	dir := t.TempDir()
+	rc := newExamCounters()
+	for _, name := range []string{"counters.json", "counters.bin"} {
+		path := filepath.Join(dir, name)
+		if err := rc.SaveFile(path); err != nil {
+			t.Fatalf("save %s err: %v", name, err)
+		}
+		info, _ := os.Stat(path)
+		fmt.Printf("%s size: %d\n", name, info.Size())
+
+		restored := NewRequestCounters()
+		restored.GetCounter("old").IncrementOfValue("v")
+		if err := restored.LoadFile(path); err != nil {
+			t.Fatalf("load %s err: %v", name, err)
+		}
+		// 恢复后键和值的类型不变，旧的计数被替换
+		if !reflect.DeepEqual(restored.GetCountersData(), rc.GetCountersData()) {
+			t.Errorf("%s: expect %v, got %v", name, rc.GetCountersData(), restored.GetCountersData())
+		}
+	}
+
+	// 临时文件都已经删除
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("expect 2 files, got %d", len(entries))
+	}
+	// 文件不存在时不报错
+	if err := NewRequestCounters().LoadFile(filepath.Join(dir, "missing.bin")); err != nil {
+		t.Errorf("expect nil for missing file, got %v", err)
+	}
+	// TextMarshaler 等类型用计数器的 stringer 保存，恢复后为字符串
+	typed := NewRequestCounters()
+	typed.GetCounter(netip.MustParseAddr("10.0.0.1")).IncrementOfValue(httpStatus(200))
+	typed.GetCounter(int64(7)).IncrementOfValue(true)
+	for _, name := range []string{"typed.json", "typed.bin"} {
+		path := filepath.Join(dir, name)
+		if err := typed.SaveFile(path); err != nil {
+			t.Fatalf("save %s err: %v", name, err)
+		}
+		restored := NewRequestCounters()
+		if err := restored.LoadFile(path); err != nil {
+			t.Fatalf("load %s err: %v", name, err)
+		}
+		fmt.Printf("%s restored: %v\n", name, restored.GetCountersData())
+		if n := restored.GetCounter("10.0.0.1").GetCountOfValue("status-200"); n != 1 {
+			t.Errorf("%s: expect 1 for text key, got %d", name, n)
+		}
+		if n := restored.GetCounter("7").GetCountOfValue("true"); n != 1 {
+			t.Errorf("%s: expect 1 for int64 key, got %d", name, n)
+		}
+	}
+
+	// 不支持的类型无法保存
+	rc.GetCounter(1.5).IncrementOfValue("v")
+	if err := rc.SaveFile(filepath.Join(dir, "bad.json")); err == nil {
+		t.Errorf("expect error for float key")
+	}
+}
+
+// 汇总多个副本的计数
+func TestMergeReplicas(t *testing.T) {
+	total := NewRequestCounters()
+	for i := 0; i < 3; i++ {
+		s, err := newExamCounters().Snapshot()
+		if err != nil {
+			t.Fatalf("snapshot err: %v", err)
+		}
+		data, _ := s.MarshalBinary()
+		var decoded CountersSnapshot
+		if err = decoded.UnmarshalBinary(data); err != nil {
+			t.Fatalf("unmarshal err: %v", err)
+		}
+		if err = total.Merge(&decoded); err != nil {
+			t.Fatalf("merge err: %v", err)
+		}
+	}
+	total.MergeCounters(newExamCounters())
+
+	data, _ := total.ToJSON()
+	fmt.Printf("merged: %+v\n", data)
+	if n := total.GetCounter("request-type").GetCountOfValue("v1"); n != 8 {
+		t.Errorf("expect 8, got %d", n)
+	}
+	if n := total.GetCounter(10001).GetCountOfValue(3); n != 4 {
+		t.Errorf("expect 4, got %d", n)
+	}
+}
+
+func TestStartFlush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "counters.bin")
+	rc := newExamCounters()
+	stop := rc.StartFlush(path, 20*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expect flushed file: %v", err)
+	}
+
+	// stop 时最后保存一次
+	rc.GetCounter("request-type").IncrementOfValue("v3")
+	if err := stop(); err != nil {
+		t.Fatalf("stop err: %v", err)
+	}
+	// 重复调用 stop 不会 panic
+	if err := stop(); err != nil {
+		t.Fatalf("second stop err: %v", err)
+	}
+	restored := NewRequestCounters()
+	if err := restored.LoadFile(path); err != nil {
+		t.Fatalf("load err: %v", err)
+	}
+	if n := restored.GetCounter("request-type").GetCountOfValue("v3"); n != 1 {
+		t.Errorf("expect 1, got %d", n)
+	}
+}
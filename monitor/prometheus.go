@@ -0,0 +1,42 @@
+package monitor
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// requestCountersCollector 把 RequestCounters 输出为 Prometheus 的计数器，计数器的键和值作为 key、value 标签
+type requestCountersCollector struct {
+	rcs  *RequestCounters
+	desc *prometheus.Desc
+}
+
+// NewRequestCountersCollector 返回 RequestCounters 的 Prometheus Collector，name 为指标名，例如：
+//
+//	prometheus.MustRegister(monitor.NewRequestCountersCollector(rcs, "grpc_requests_total"))
+//
+// rcs.GetCounter("request-type").IncrementOfValue("v1") 输出为 grpc_requests_total{key="request-type",value="v1"}
+func NewRequestCountersCollector(rcs *RequestCounters, name string) prometheus.Collector {
+	return &requestCountersCollector{
+		rcs:  rcs,
+		desc: prometheus.NewDesc(name, "Number of requests counted by monitor.RequestCounters.", []string{"key", "value"}, nil),
+	}
+}
+
+func (c *requestCountersCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect 每次抓取时读取计数器的当前数据
+// 不同类型的键或值转换为标签后可能相同（如 10001 和 "10001"），先按标签合并计数，避免输出重复的序列
+func (c *requestCountersCollector) Collect(ch chan<- prometheus.Metric) {
+	merged := make(map[[2]string]int)
+	for key, counts := range c.rcs.GetCountersData() {
+		for value, count := range counts {
+			merged[[2]string{fmt.Sprint(key), fmt.Sprint(value)}] += count
+		}
+	}
+	for labels, count := range merged {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, float64(count), labels[0], labels[1])
+	}
+}
@@ -0,0 +1,40 @@
+package monitor
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"strings"
+	"testing"
+)
+
+func TestRequestCountersCollector(t *testing.T) {
+	rc := NewRequestCounters()
+	rc.GetCounter("request-type").IncrementOfValue("v1")
+	rc.GetCounter("request-type").IncrementOfValue("v1")
+	rc.GetCounter(10001).IncrementOfValue(3)
+	// 字符串 "10001" 和整数 10001 的标签相同，合并为一个序列
+	rc.GetCounter("10001").IncrementOfValue("3")
+
+	collector := NewRequestCountersCollector(rc, "grpc_requests_total")
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	expected := `
+# HELP grpc_requests_total Number of requests counted by monitor.RequestCounters.
+# TYPE grpc_requests_total counter
+grpc_requests_total{key="10001",value="3"} 2
+grpc_requests_total{key="request-type",value="v1"} 2
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "grpc_requests_total"); err != nil {
+		t.Errorf("unexpected metrics: %v", err)
+	}
+
+	// 计数变化后，下一次抓取读取到新的值
+	rc.GetCounter("request-type").IncrementOfValue("v2")
+	n := testutil.CollectAndCount(collector)
+	fmt.Printf("metrics count: %d\n", n)
+	if n != 3 {
+		t.Errorf("expect 3 metrics, got %d", n)
+	}
+}
@@ -1,132 +1,89 @@
 package monitor
 
-import (
-	"fmt"
-	"strconv"
-	"sync"
-)
+// RequestCounters 兼容原有 API 的计数器集合，键和值都是 interface{}，新代码建议直接使用 KeyCounters[K, V]
+// 与 KeyCounters[interface{}, interface{}] 是同一个结构，两者的指针可以直接转换
+type RequestCounters KeyCounters[interface{}, interface{}]
 
-type RequestCounters struct {
-	// 读写互斥锁
-	mu       sync.RWMutex
-	counters map[interface{}]*RequestCounter
-}
+// RequestCounter 兼容原有 API 的计数器，值是 interface{}，计数为 int，新代码建议直接使用 KeyCounter[K]
+type RequestCounter KeyCounter[interface{}]
 
-type RequestCounter struct {
-	// 读写互斥锁
-	mu     sync.RWMutex
-	counts map[interface{}]int
+func NewCounter() *RequestCounter {
+	return (*RequestCounter)(NewKeyCounter[interface{}](nil))
 }
 
-func NewCounter() *RequestCounter {
-	return &RequestCounter{
-		counts: make(map[interface{}]int),
-	}
+// Typed 返回底层的泛型计数器
+func (rc *RequestCounter) Typed() *KeyCounter[interface{}] {
+	return (*KeyCounter[interface{}])(rc)
 }
 
 func (rc *RequestCounter) IncrementOfValue(RequestValue interface{}) {
-	rc.mu.Lock()
-	defer rc.mu.Unlock()
-	rc.counts[RequestValue]++
+	rc.Typed().Inc(RequestValue)
 }
 
 func (rc *RequestCounter) GetCountOfValue(RequestValue interface{}) int {
-	rc.mu.RLock()
-	defer rc.mu.RUnlock()
-	return rc.counts[RequestValue]
+	return int(rc.Typed().Get(RequestValue))
 }
 
 func (rc *RequestCounter) GetData() map[interface{}]int {
-	rc.mu.RLock()
-	defer rc.mu.RUnlock()
 	data := make(map[interface{}]int)
-	for key, value := range rc.counts {
-		data[key] = value
+	for key, value := range rc.Typed().Data() {
+		data[key] = int(value)
 	}
 	return data
 }
 
+// ToJSON 键支持 KeyString 能转换的类型，string、int 的输出与之前相同
 func (rc *RequestCounter) ToJSON() (map[string]int, error) {
-	data := rc.GetData()
-	jsonMap := make(map[string]int)
-
+	data, err := rc.Typed().ToJSON()
+	if err != nil {
+		return nil, err
+	}
+	jsonMap := make(map[string]int, len(data))
 	for key, value := range data {
-		switch k := key.(type) {
-		case string:
-			jsonMap[k] = value
-		case int:
-			jsonMap[strconv.Itoa(k)] = value
-		default:
-			return nil, fmt.Errorf("unsupported value key type: %T", key)
-		}
+		jsonMap[key] = int(value)
 	}
-
 	return jsonMap, nil
 }
 
 func NewRequestCounters() *RequestCounters {
-	return &RequestCounters{
-		counters: make(map[interface{}]*RequestCounter),
-	}
+	return (*RequestCounters)(NewKeyCounters[interface{}, interface{}](nil, nil))
 }
 
-func (rcs *RequestCounters) GetCounter(RequestKey interface{}) *RequestCounter {
-	// 加写锁防止同时 NewCounter
-	rcs.mu.Lock()
-	defer rcs.mu.Unlock()
-	if rcs.counters[RequestKey] == nil {
-		rcs.counters[RequestKey] = NewCounter()
-	}
+// Typed 返回底层的泛型计数器集合
+func (rcs *RequestCounters) Typed() *KeyCounters[interface{}, interface{}] {
+	return (*KeyCounters[interface{}, interface{}])(rcs)
+}
 
-	return rcs.counters[RequestKey]
+// GetCounter 返回键的计数器，已经存在时不加锁
+func (rcs *RequestCounters) GetCounter(RequestKey interface{}) *RequestCounter {
+	return (*RequestCounter)(rcs.Typed().Get(RequestKey))
 }
 
 func (rcs *RequestCounters) GetCountersData() map[interface{}]map[interface{}]int {
-	rcs.mu.RLock()
-	defer rcs.mu.RUnlock()
-
 	data := make(map[interface{}]map[interface{}]int)
 
 	// 遍历每个计数器
-	for key, counter := range rcs.counters {
-		data[key] = counter.GetData()
+	for key, counts := range rcs.Typed().Data() {
+		data[key] = make(map[interface{}]int, len(counts))
+		for value, count := range counts {
+			data[key][value] = int(count)
+		}
 	}
 
 	return data
 }
 
 func (rcs *RequestCounters) ToJSON() (map[string]map[string]int, error) {
-	// 不用加锁，获取到数据后都是剩余的一些处理
-	data := rcs.GetCountersData()
-	jsonMap := make(map[string]map[string]int)
-
-	for counterKey, counterData := range data {
-		var keyStr string
-		var valueMap map[string]int
-
-		switch k := counterKey.(type) {
-		case string:
-			keyStr = k
-		case int:
-			keyStr = strconv.Itoa(k)
-		default:
-			return nil, fmt.Errorf("unsupported counter key type: %T", counterKey)
-		}
-
-		valueMap = make(map[string]int)
-		for key, value := range counterData {
-			switch k := key.(type) {
-			case string:
-				valueMap[k] = value
-			case int:
-				valueMap[strconv.Itoa(k)] = value
-			default:
-				return nil, fmt.Errorf("unsupported value key type: %T", key)
-			}
+	data, err := rcs.Typed().ToJSON()
+	if err != nil {
+		return nil, err
+	}
+	jsonMap := make(map[string]map[string]int, len(data))
+	for key, counts := range data {
+		jsonMap[key] = make(map[string]int, len(counts))
+		for value, count := range counts {
+			jsonMap[key][value] = int(count)
 		}
-
-		jsonMap[keyStr] = valueMap
 	}
-
 	return jsonMap, nil
 }
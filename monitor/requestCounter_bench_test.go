@@ -0,0 +1,85 @@
+package monitor
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// mutexCounters 重构前的实现：GetCounter 每次都加写锁，IncrementOfValue 加 map 的锁，作为基准对比
+type mutexCounters struct {
+	mu       sync.RWMutex
+	counters map[interface{}]*mutexCounter
+}
+
+type mutexCounter struct {
+	mu     sync.RWMutex
+	counts map[interface{}]int
+}
+
+func (mcs *mutexCounters) GetCounter(key interface{}) *mutexCounter {
+	mcs.mu.Lock()
+	defer mcs.mu.Unlock()
+	if mcs.counters[key] == nil {
+		mcs.counters[key] = &mutexCounter{counts: make(map[interface{}]int)}
+	}
+	return mcs.counters[key]
+}
+
+func (mc *mutexCounter) IncrementOfValue(value interface{}) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.counts[value]++
+}
+
+// 用 -cpu 对比不同 GOMAXPROCS 下的吞吐，例如：
+//
+//	go test -run ^$ -bench Increment -cpu 1,2,4,8
+//
+// 多核机器上分片计数器的 ns/op 随核数增加基本不变，加锁的实现随核数增加而上升
+func BenchmarkIncrementOfValue(b *testing.B) {
+	rc := NewRequestCounters()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			rc.GetCounter("group").IncrementOfValue("v1")
+		}
+	})
+}
+
+func BenchmarkIncrementOfValueMutex(b *testing.B) {
+	mc := &mutexCounters{counters: make(map[interface{}]*mutexCounter)}
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			mc.GetCounter("group").IncrementOfValue("v1")
+		}
+	})
+}
+
+// 多个值分散在不同的键上
+func BenchmarkIncrementOfValueSpread(b *testing.B) {
+	rc := NewRequestCounters()
+	keys := make([]string, 16)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			rc.GetCounter(keys[i&15]).IncrementOfValue(i & 3)
+			i++
+		}
+	})
+}
+
+func BenchmarkGetCountersData(b *testing.B) {
+	rc := NewRequestCounters()
+	for i := 0; i < 16; i++ {
+		for v := 0; v < 4; v++ {
+			rc.GetCounter(i).IncrementOfValue(v)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rc.GetCountersData()
+	}
+}
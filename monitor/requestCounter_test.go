@@ -76,3 +76,32 @@ func get(rc *RequestCounters) {
 		time.Sleep(1e9)
 	}
 }
+
+// 并发递增同一个值不丢失计数
+func TestRequestCounterConcurrentIncrement(t *testing.T) {
+	var wg sync.WaitGroup
+	rc := NewRequestCounters()
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				rc.GetCounter("request-type").IncrementOfValue("v1")
+				rc.GetCounter(10001).IncrementOfValue(j % 2)
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, err := rc.ToJSON()
+	if err != nil {
+		t.Fatalf("ToJSON err: %v", err)
+	}
+	fmt.Printf("data: %+v\n", data)
+	if data["request-type"]["v1"] != 8000 || data["10001"]["0"] != 4000 || data["10001"]["1"] != 4000 {
+		t.Errorf("unexpected data: %+v", data)
+	}
+	if n := rc.GetCounter("request-type").GetCountOfValue("v2"); n != 0 {
+		t.Errorf("expect 0, got %d", n)
+	}
+}
@@ -0,0 +1,256 @@
+package monitor
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// WindowCounters 按键保存滑动窗口计数器，与 RequestCounters 用法相同，但只统计最近一段时间的请求
+type WindowCounters struct {
+	// 读写互斥锁
+	mu       sync.RWMutex
+	window   time.Duration
+	buckets  int
+	counters map[interface{}]*WindowCounter
+}
+
+// WindowCounter 滑动窗口计数器，实现 Counter 接口
+// 窗口分成若干个桶组成环形缓冲区，每个桶记录一段时间内各个值的次数，过期的桶在复用时清空
+// 例如 NewWindowCounter(5*time.Minute, 300) 每个桶 1 秒，可以查询最近 10 秒、1 分钟、5 分钟的请求速率
+type WindowCounter struct {
+	// 读写互斥锁
+	mu      sync.RWMutex
+	window  time.Duration
+	width   time.Duration
+	buckets []windowBucket
+	// now 当前时间，测试时替换
+	now func() time.Time
+}
+
+// windowBucket 环形缓冲区中的一个桶
+type windowBucket struct {
+	start  time.Time
+	counts map[interface{}]int
+}
+
+// NewWindowCounter 创建窗口为 window、分为 buckets 个桶的计数器，桶越多统计越精确，buckets 小于 1 时为 1
+func NewWindowCounter(window time.Duration, buckets int) *WindowCounter {
+	if buckets < 1 {
+		buckets = 1
+	}
+	width := window / time.Duration(buckets)
+	if width <= 0 {
+		width = 1
+	}
+	return &WindowCounter{
+		window:  width * time.Duration(buckets),
+		width:   width,
+		buckets: make([]windowBucket, buckets),
+		now:     time.Now,
+	}
+}
+
+// bucket 返回当前时间所在的桶，桶已经过期时清空后复用，调用方需要持有写锁
+func (wc *WindowCounter) bucket(now time.Time) *windowBucket {
+	start := now.Truncate(wc.width)
+	b := &wc.buckets[int(start.UnixNano()/int64(wc.width))%len(wc.buckets)]
+	if !b.start.Equal(start) {
+		*b = windowBucket{start: start, counts: make(map[interface{}]int)}
+	}
+	return b
+}
+
+// inWindow 桶是否在最近 d 时间内，当前时间所在的桶算在内
+func (wc *WindowCounter) inWindow(b *windowBucket, now time.Time, d time.Duration) bool {
+	return b.counts != nil && now.Sub(b.start) < d
+}
+
+func (wc *WindowCounter) IncrementOfValue(RequestValue interface{}) {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	wc.bucket(wc.now()).counts[RequestValue]++
+}
+
+// GetCountOfValue 返回窗口内值的次数
+func (wc *WindowCounter) GetCountOfValue(RequestValue interface{}) int {
+	return wc.CountIn(RequestValue, wc.window)
+}
+
+// GetData 返回窗口内各个值的次数
+func (wc *WindowCounter) GetData() map[interface{}]int {
+	return wc.DataIn(wc.window)
+}
+
+// CountIn 返回最近 d 时间内值的次数，d 超过窗口时按窗口计算，精度为一个桶的宽度
+func (wc *WindowCounter) CountIn(RequestValue interface{}, d time.Duration) int {
+	wc.mu.RLock()
+	defer wc.mu.RUnlock()
+	now := wc.now()
+	count := 0
+	for i := range wc.buckets {
+		if wc.inWindow(&wc.buckets[i], now, d) {
+			count += wc.buckets[i].counts[RequestValue]
+		}
+	}
+	return count
+}
+
+// DataIn 返回最近 d 时间内各个值的次数
+func (wc *WindowCounter) DataIn(d time.Duration) map[interface{}]int {
+	wc.mu.RLock()
+	defer wc.mu.RUnlock()
+	now := wc.now()
+	data := make(map[interface{}]int)
+	for i := range wc.buckets {
+		if !wc.inWindow(&wc.buckets[i], now, d) {
+			continue
+		}
+		for value, count := range wc.buckets[i].counts {
+			data[value] += count
+		}
+	}
+	return data
+}
+
+// Rate 返回最近 d 时间内值的每秒次数
+func (wc *WindowCounter) Rate(RequestValue interface{}, d time.Duration) float64 {
+	d = wc.clamp(d)
+	return float64(wc.CountIn(RequestValue, d)) / d.Seconds()
+}
+
+// Rates 返回最近 d 时间内各个值的每秒次数
+func (wc *WindowCounter) Rates(d time.Duration) map[interface{}]float64 {
+	d = wc.clamp(d)
+	rates := make(map[interface{}]float64)
+	for value, count := range wc.DataIn(d) {
+		rates[value] = float64(count) / d.Seconds()
+	}
+	return rates
+}
+
+// clamp 查询时间不能超过窗口，也不能小于一个桶
+func (wc *WindowCounter) clamp(d time.Duration) time.Duration {
+	if d <= 0 || d > wc.window {
+		return wc.window
+	}
+	if d < wc.width {
+		return wc.width
+	}
+	return d
+}
+
+// Reset 清空计数
+func (wc *WindowCounter) Reset() {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	wc.buckets = make([]windowBucket, len(wc.buckets))
+}
+
+// Snapshot 返回窗口内各个值的次数，reset 为 true 时同时清空计数，两步在同一把锁内完成，不会丢失计数
+func (wc *WindowCounter) Snapshot(reset bool) map[interface{}]int {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	now := wc.now()
+	data := make(map[interface{}]int)
+	for i := range wc.buckets {
+		if !wc.inWindow(&wc.buckets[i], now, wc.window) {
+			continue
+		}
+		for value, count := range wc.buckets[i].counts {
+			data[value] += count
+		}
+	}
+	if reset {
+		wc.buckets = make([]windowBucket, len(wc.buckets))
+	}
+	return data
+}
+
+func (wc *WindowCounter) ToJSON() (map[string]int, error) {
+	return valuesToJSON(wc.GetData())
+}
+
+// NewWindowCounters 创建滑动窗口计数器集合，每个计数器的窗口为 window、分为 buckets 个桶
+func NewWindowCounters(window time.Duration, buckets int) *WindowCounters {
+	return &WindowCounters{
+		window:   window,
+		buckets:  buckets,
+		counters: make(map[interface{}]*WindowCounter),
+	}
+}
+
+func (wcs *WindowCounters) GetCounter(RequestKey interface{}) *WindowCounter {
+	// 加写锁防止同时 NewWindowCounter
+	wcs.mu.Lock()
+	defer wcs.mu.Unlock()
+	if wcs.counters[RequestKey] == nil {
+		wcs.counters[RequestKey] = NewWindowCounter(wcs.window, wcs.buckets)
+	}
+
+	return wcs.counters[RequestKey]
+}
+
+// GetCountersData 返回窗口内每个键各个值的次数
+func (wcs *WindowCounters) GetCountersData() map[interface{}]map[interface{}]int {
+	wcs.mu.RLock()
+	defer wcs.mu.RUnlock()
+
+	data := make(map[interface{}]map[interface{}]int)
+	for key, counter := range wcs.counters {
+		data[key] = counter.GetData()
+	}
+	return data
+}
+
+// GetRates 返回最近 d 时间内每个键各个值的每秒次数
+func (wcs *WindowCounters) GetRates(d time.Duration) map[interface{}]map[interface{}]float64 {
+	wcs.mu.RLock()
+	defer wcs.mu.RUnlock()
+
+	rates := make(map[interface{}]map[interface{}]float64)
+	for key, counter := range wcs.counters {
+		rates[key] = counter.Rates(d)
+	}
+	return rates
+}
+
+// Snapshot 返回窗口内每个键各个值的次数，reset 为 true 时同时清空所有计数器
+func (wcs *WindowCounters) Snapshot(reset bool) map[interface{}]map[interface{}]int {
+	wcs.mu.RLock()
+	defer wcs.mu.RUnlock()
+
+	data := make(map[interface{}]map[interface{}]int)
+	for key, counter := range wcs.counters {
+		data[key] = counter.Snapshot(reset)
+	}
+	return data
+}
+
+func (wcs *WindowCounters) ToJSON() (map[string]map[string]int, error) {
+	jsonMap := make(map[string]map[string]int)
+	for counterKey, counterData := range wcs.GetCountersData() {
+		keyStr, err := KeyString(counterKey)
+		if err != nil {
+			return nil, fmt.Errorf("counter key %T: %w", counterKey, err)
+		}
+		valueMap, err := valuesToJSON(counterData)
+		if err != nil {
+			return nil, err
+		}
+		jsonMap[keyStr] = valueMap
+	}
+	return jsonMap, nil
+}
+
+func valuesToJSON(data map[interface{}]int) (map[string]int, error) {
+	jsonMap := make(map[string]int)
+	for key, value := range data {
+		keyStr, err := KeyString(key)
+		if err != nil {
+			return nil, fmt.Errorf("value key %T: %w", key, err)
+		}
+		jsonMap[keyStr] = value
+	}
+	return jsonMap, nil
+}
@@ -0,0 +1,83 @@
+package monitor
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWindowCounter(t *testing.T) {
+	var _ Counter = (*WindowCounter)(nil)
+
+	// 5 分钟窗口，每个桶 1 秒，时间由测试推进
+	now := time.Unix(1700000000, 0)
+	wc := NewWindowCounter(5*time.Minute, 300)
+	wc.now = func() time.Time { return now }
+
+	// 最近 10 秒内每秒 2 次 v1，更早的 50 秒内每秒 1 次 v1
+	for i := 0; i < 60; i++ {
+		wc.IncrementOfValue("v1")
+		if i >= 50 {
+			wc.IncrementOfValue("v1")
+		}
+		now = now.Add(time.Second)
+	}
+	now = now.Add(-time.Second)
+	wc.IncrementOfValue("v2")
+
+	fmt.Printf("data: %+v\n", wc.GetData())
+	fmt.Printf("rate 10s: %v, rate 1m: %v, rate 5m: %v\n",
+		wc.Rate("v1", 10*time.Second), wc.Rate("v1", time.Minute), wc.Rate("v1", 5*time.Minute))
+	if wc.GetCountOfValue("v1") != 70 || wc.GetCountOfValue("v2") != 1 {
+		t.Errorf("unexpected data: %+v", wc.GetData())
+	}
+	if r := wc.Rate("v1", 10*time.Second); r != 2 {
+		t.Errorf("expect 2/s in 10s, got %v", r)
+	}
+	if r := wc.Rate("v1", time.Minute); r != 70.0/60 {
+		t.Errorf("expect 70/60 per second in 1m, got %v", r)
+	}
+
+	// 5 分钟后前面的桶过期
+	now = now.Add(5*time.Minute - 9*time.Second)
+	fmt.Printf("data after 5m: %+v\n", wc.GetData())
+	if wc.GetCountOfValue("v1") != 18 {
+		t.Errorf("expect 18 in window, got %d", wc.GetCountOfValue("v1"))
+	}
+	// 过期的桶被复用时清空
+	wc.IncrementOfValue("v1")
+	if wc.GetCountOfValue("v1") != 19 {
+		t.Errorf("expect 19 in window, got %d", wc.GetCountOfValue("v1"))
+	}
+
+	snapshot := wc.Snapshot(true)
+	fmt.Printf("snapshot: %+v, after reset: %+v\n", snapshot, wc.GetData())
+	if snapshot["v1"] != 19 || len(wc.GetData()) != 0 {
+		t.Errorf("unexpected snapshot: %+v", snapshot)
+	}
+}
+
+func TestWindowCounters(t *testing.T) {
+	wcs := NewWindowCounters(time.Minute, 60)
+	wcs.GetCounter("request-type").IncrementOfValue("v1")
+	wcs.GetCounter("request-type").IncrementOfValue("v1")
+	wcs.GetCounter(10001).IncrementOfValue(3)
+
+	data, err := wcs.ToJSON()
+	if err != nil {
+		t.Fatalf("ToJSON err: %v", err)
+	}
+	fmt.Printf("data: %+v\n", data)
+	fmt.Printf("rates: %+v\n", wcs.GetRates(10*time.Second))
+	if data["request-type"]["v1"] != 2 || data["10001"]["3"] != 1 {
+		t.Errorf("unexpected data: %+v", data)
+	}
+	if r := wcs.GetRates(10 * time.Second)["request-type"]["v1"]; r != 0.2 {
+		t.Errorf("expect 0.2/s, got %v", r)
+	}
+
+	wcs.Snapshot(true)
+	if n := wcs.GetCounter("request-type").GetCountOfValue("v1"); n != 0 {
+		t.Errorf("expect 0 after reset, got %d", n)
+	}
+}
@@ -0,0 +1,159 @@
+package static
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/resolver"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileScheme 从文件读取地址列表的 scheme
+const FileScheme = "file"
+
+// defaultWatchInterval 检查文件是否变化的间隔
+const defaultWatchInterval = 5 * time.Second
+
+// endpointsFile 地址文件的格式，例如：
+//
+//	{
+//	  "name": "exam_svc",
+//	  "addresses": ["127.0.0.1:8081", "127.0.0.1:8082"]
+//	}
+type endpointsFile struct {
+	Name      string   `json:"name"`
+	Addresses []string `json:"addresses"`
+}
+
+type fileBuilder struct {
+	interval time.Duration
+}
+
+type fileResolver struct {
+	wg       sync.WaitGroup
+	cc       resolver.ClientConn
+	path     string
+	svcName  string
+	interval time.Duration
+	modTime  time.Time
+	size     int64
+	resolveC chan struct{}
+	quitC    chan struct{}
+}
+
+// NewFileBuilder 返回 file resolver 的 builder
+func NewFileBuilder() resolver.Builder {
+	return &fileBuilder{interval: defaultWatchInterval}
+}
+
+// Build 构建 resolver
+// 约定: target 形式为 file://svcName/path/endpoints.json，endpoint 总是按绝对路径处理
+// authority 不为空时作为服务名写入 ServerName，否则使用文件中的 name 字段，两者都没有则返回错误
+func (fb *fileBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	log.Info().Msgf("calling file build, target: %v\n", target)
+
+	fr := &fileResolver{
+		cc:       cc,
+		path:     "/" + target.Endpoint,
+		svcName:  target.Authority,
+		interval: fb.interval,
+		resolveC: make(chan struct{}, 1),
+		quitC:    make(chan struct{}),
+	}
+
+	// 第一次读取失败直接返回错误，避免 Dial 成功但永远没有地址
+	if err := fr.reload(); err != nil {
+		return nil, err
+	}
+
+	fr.wg.Add(1)
+	go fr.watcher()
+	return fr, nil
+}
+
+func (fb *fileBuilder) Scheme() string {
+	return FileScheme
+}
+
+// watcher 定期检查文件的修改时间和大小，变化时重新加载
+func (fr *fileResolver) watcher() {
+	defer fr.wg.Done()
+	ticker := time.NewTicker(fr.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-fr.quitC:
+			return
+		case <-fr.resolveC:
+			if err := fr.reload(); err != nil {
+				fr.cc.ReportError(err)
+			}
+		case <-ticker.C:
+			info, err := os.Stat(fr.path)
+			if err != nil {
+				log.Error().Msgf("stat %s error: %v", fr.path, err)
+				fr.cc.ReportError(err)
+				continue
+			}
+			if info.ModTime().Equal(fr.modTime) && info.Size() == fr.size {
+				continue
+			}
+			if err = fr.reload(); err != nil {
+				fr.cc.ReportError(err)
+			}
+		}
+	}
+}
+
+// reload 读取文件并推送新的地址列表，读取失败时保留原有地址
+func (fr *fileResolver) reload() error {
+	info, err := os.Stat(fr.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(fr.path)
+	if err != nil {
+		log.Error().Msgf("read %s error: %v", fr.path, err)
+		return err
+	}
+	var ef endpointsFile
+	if err = json.Unmarshal(data, &ef); err != nil {
+		log.Error().Msgf("json unmarshal %s error: %v", fr.path, err)
+		return err
+	}
+	fr.modTime = info.ModTime()
+	fr.size = info.Size()
+
+	svcName := fr.svcName
+	if svcName == "" {
+		svcName = ef.Name
+	}
+	if svcName == "" {
+		return fmt.Errorf("file resolver: no service name for %s, use file://svcName/path or set \"name\" in the file", fr.path)
+	}
+	addrs := toAddresses(ef.Addresses, svcName)
+	if len(addrs) == 0 {
+		return fmt.Errorf("file resolver: no address in %s", fr.path)
+	}
+
+	log.Info().Msgf("file resolver newAddrs: %v\n", addrs)
+	fr.cc.UpdateState(resolver.State{Addresses: addrs})
+	return nil
+}
+
+// ResolveNow 立即重新读取文件
+func (fr *fileResolver) ResolveNow(opt resolver.ResolveNowOptions) {
+	select {
+	case fr.resolveC <- struct{}{}:
+	default:
+	}
+}
+
+// Close 关闭观察者。
+func (fr *fileResolver) Close() {
+	close(fr.quitC)
+	fr.wg.Wait()
+}
@@ -0,0 +1,94 @@
+package static
+
+import (
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/resolver"
+	"strings"
+)
+
+// Scheme 静态地址列表的 scheme
+const Scheme = "static"
+
+// InitResolver 初始化注册 static 和 file 两种 resolver
+func InitResolver() {
+	log.Info().Msg("static init\n")
+	resolver.Register(NewBuilder())
+	resolver.Register(NewFileBuilder())
+}
+
+type staticBuilder struct {
+	// svcName target 中没有服务名（static:///host1:port）时使用的服务名
+	svcName string
+}
+
+type staticResolver struct {
+	cc    resolver.ClientConn
+	addrs []resolver.Address
+}
+
+// NewBuilder 返回 static resolver 的 builder
+func NewBuilder() resolver.Builder {
+	return &staticBuilder{}
+}
+
+// NewBuilderWithName 返回 static resolver 的 builder，target 中没有服务名时使用 svcName
+func NewBuilderWithName(svcName string) resolver.Builder {
+	return &staticBuilder{svcName: svcName}
+}
+
+// Build 构建 resolver
+// 约定: target 形式为 static://svcName/host1:port,host2:port，authority 为服务名，endpoint 为逗号分隔的地址列表
+// 服务名会写入 ServerName，allocator 依赖它读取对应服务的配置；authority 为空时（static:///host1:port）
+// 使用 NewBuilderWithName 指定的服务名，两者都没有则返回错误
+func (sb *staticBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	log.Info().Msgf("calling static build, target: %v\n", target)
+
+	svcName := target.Authority
+	if svcName == "" {
+		svcName = sb.svcName
+	}
+	if svcName == "" {
+		return nil, fmt.Errorf("static resolver: no service name in target %q, use static://svcName/host1:port,host2:port", target.Endpoint)
+	}
+
+	addrs := toAddresses(strings.Split(target.Endpoint, ","), svcName)
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("static resolver: no address in target %q", target.Endpoint)
+	}
+
+	sr := &staticResolver{
+		cc:    cc,
+		addrs: addrs,
+	}
+	sr.cc.UpdateState(resolver.State{Addresses: sr.addrs})
+	return sr, nil
+}
+
+func (sb *staticBuilder) Scheme() string {
+	return Scheme
+}
+
+// ResolveNow 地址列表固定不变，重新推送一次即可
+func (sr *staticResolver) ResolveNow(opt resolver.ResolveNowOptions) {
+	sr.cc.UpdateState(resolver.State{Addresses: sr.addrs})
+}
+
+// Close 静态列表没有后台任务，不需要释放
+func (sr *staticResolver) Close() {
+}
+
+// toAddresses 把地址列表转换为 resolver.Address，并写入服务名，忽略空项与重复项
+func toAddresses(list []string, svcName string) []resolver.Address {
+	var addrs []resolver.Address
+	seen := make(map[string]bool)
+	for _, a := range list {
+		a = strings.TrimSpace(a)
+		if a == "" || seen[a] {
+			continue
+		}
+		seen[a] = true
+		addrs = append(addrs, resolver.Address{Addr: a, ServerName: svcName})
+	}
+	return addrs
+}
@@ -0,0 +1,144 @@
+package static
+
+import (
+	"fmt"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeClientConn struct {
+	mu    sync.Mutex
+	state resolver.State
+	err   error
+}
+
+func (cc *fakeClientConn) UpdateState(s resolver.State) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.state = s
+}
+func (cc *fakeClientConn) ReportError(err error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.err = err
+}
+func (cc *fakeClientConn) NewAddress(addresses []resolver.Address) {
+	cc.UpdateState(resolver.State{Addresses: addresses})
+}
+func (cc *fakeClientConn) NewServiceConfig(string) {
+}
+func (cc *fakeClientConn) ParseServiceConfig(string) *serviceconfig.ParseResult {
+	return nil
+}
+func (cc *fakeClientConn) addrs() []resolver.Address {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.state.Addresses
+}
+
+func TestStaticResolver(t *testing.T) {
+	cc := &fakeClientConn{}
+	target := resolver.Target{Scheme: Scheme, Authority: "exam_svc", Endpoint: "1.0.0.1:1, 1.0.0.2:1,,1.0.0.1:1"}
+	r, err := NewBuilder().Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("build err: %v", err)
+	}
+	defer r.Close()
+
+	addrs := cc.addrs()
+	fmt.Printf("static addrs: %+v\n", addrs)
+	if len(addrs) != 2 {
+		t.Fatalf("expect 2 addresses, got %d", len(addrs))
+	}
+	for _, a := range addrs {
+		if a.ServerName != "exam_svc" {
+			t.Errorf("expect ServerName exam_svc, got %s", a.ServerName)
+		}
+	}
+
+	if _, err = NewBuilder().Build(resolver.Target{Scheme: Scheme, Authority: "exam_svc", Endpoint: ","}, cc, resolver.BuildOptions{}); err == nil {
+		t.Errorf("expect error for empty address list")
+	}
+
+	// static:///host1:port 没有服务名，需要通过 NewBuilderWithName 指定
+	target = resolver.Target{Scheme: Scheme, Endpoint: "1.0.0.3:1"}
+	if _, err = NewBuilder().Build(target, cc, resolver.BuildOptions{}); err == nil {
+		t.Errorf("expect error for empty service name")
+	}
+	if _, err = NewBuilderWithName("exam_svc").Build(target, cc, resolver.BuildOptions{}); err != nil {
+		t.Fatalf("build with name err: %v", err)
+	}
+	addrs = cc.addrs()
+	fmt.Printf("static addrs without authority: %+v\n", addrs)
+	if len(addrs) != 1 || addrs[0].ServerName != "exam_svc" {
+		t.Errorf("unexpected addrs: %+v", addrs)
+	}
+}
+
+func TestFileResolver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "endpoints.json")
+	if err := os.WriteFile(path, []byte(`{"name":"exam_svc","addresses":["1.0.0.1:1","1.0.0.2:1"]}`), 0644); err != nil {
+		t.Fatalf("writeFile err: %v", err)
+	}
+
+	cc := &fakeClientConn{}
+	fb := &fileBuilder{interval: 10 * time.Millisecond}
+	// target 的 endpoint 不带开头的 /，与 grpc 解析 file:///path 的结果一致
+	r, err := fb.Build(resolver.Target{Scheme: FileScheme, Endpoint: path[1:]}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("build err: %v", err)
+	}
+	defer r.Close()
+
+	addrs := cc.addrs()
+	fmt.Printf("file addrs: %+v\n", addrs)
+	if len(addrs) != 2 || addrs[0].ServerName != "exam_svc" {
+		t.Fatalf("unexpected addrs: %+v", addrs)
+	}
+
+	// 修改文件，等待 watcher 重新加载
+	if err = os.WriteFile(path, []byte(`{"name":"exam_svc","addresses":["1.0.0.3:1"]}`), 0644); err != nil {
+		t.Fatalf("writeFile err: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if addrs = cc.addrs(); len(addrs) == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	fmt.Printf("file addrs after modify: %+v\n", addrs)
+	if len(addrs) != 1 || addrs[0].Addr != "1.0.0.3:1" {
+		t.Errorf("file change not picked up: %+v", addrs)
+	}
+}
+
+func TestFileResolverNoName(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "endpoints.json")
+	if err := os.WriteFile(path, []byte(`{"addresses":["1.0.0.1:1"]}`), 0644); err != nil {
+		t.Fatalf("writeFile err: %v", err)
+	}
+
+	// authority 和文件中的 name 都为空时不能构建，否则 allocator 会为服务 "" 注册 picker
+	cc := &fakeClientConn{}
+	fb := &fileBuilder{interval: 10 * time.Millisecond}
+	_, err := fb.Build(resolver.Target{Scheme: FileScheme, Endpoint: path[1:]}, cc, resolver.BuildOptions{})
+	fmt.Printf("build without service name: %v\n", err)
+	if err == nil {
+		t.Fatalf("expect error without service name, got addrs %+v", cc.addrs())
+	}
+
+	r, err := fb.Build(resolver.Target{Scheme: FileScheme, Authority: "exam_svc", Endpoint: path[1:]}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("build err: %v", err)
+	}
+	defer r.Close()
+	if addrs := cc.addrs(); len(addrs) != 1 || addrs[0].ServerName != "exam_svc" {
+		t.Errorf("unexpected addrs: %+v", addrs)
+	}
+}